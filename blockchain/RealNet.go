@@ -10,7 +10,10 @@ import (
 
 type RealNet struct {
 	Clients map[string]TcpConnectionInfo
-	mu      sync.Mutex
+	// The port this node listens on, sent with every message so that the
+	// receiver can tell which registered peer it came from.
+	From string
+	mu   sync.Mutex
 }
 
 // Registers clients to the network.
@@ -29,6 +32,7 @@ func (f *RealNet) Broadcast(msg string, data []byte) {
 
 		var conn TcpData
 		conn.Msg = msg
+		conn.From = (*f).From
 		conn.Data = make([]byte, len(data))
 		copy(conn.Data, data)
 
@@ -61,6 +65,26 @@ func (f *RealNet) Recognizes(client *TcpConnectionInfo) bool {
 	}
 }
 
+// Tests whether a client listening on connection registered with the
+// network from host. Clients without a host came from the config and are
+// reached on localhost, so they can only be on a loopback address.
+func (f *RealNet) RecognizesPeer(host string, connection string) bool {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	for _, client := range f.Clients {
+		if client.Connection != connection {
+			continue
+		}
+		if client.Host == host {
+			return true
+		}
+		if ip := net.ParseIP(host); client.Host == "" && ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
 func (f *RealNet) SendMessage(addr string, msg string, jsonByte []byte) {
 
 	(*f).mu.Lock()
@@ -74,6 +98,7 @@ func (f *RealNet) SendMessage(addr string, msg string, jsonByte []byte) {
 
 	var conn TcpData
 	conn.Msg = msg
+	conn.From = (*f).From
 	conn.Data = make([]byte, len(jsonByte))
 	copy(conn.Data, jsonByte)
 
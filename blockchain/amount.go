@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An amount of gold. Sums and differences that come from user input go
+// through CheckedAdd and CheckedSub, which fail instead of silently wrapping
+// around, so nobody can mint money by overflowing a sum.
+type Amount uint64
+
+const MAX_AMOUNT Amount = ^Amount(0)
+
+var (
+	ErrAmountOverflow  = errors.New("amount overflow")
+	ErrAmountUnderflow = errors.New("amount underflow")
+)
+
+func (a Amount) CheckedAdd(b Amount) (Amount, error) {
+	if a > MAX_AMOUNT-b {
+		return 0, fmt.Errorf("%w: %d + %d", ErrAmountOverflow, a, b)
+	}
+	return a + b, nil
+}
+
+func (a Amount) CheckedSub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, fmt.Errorf("%w: %d - %d", ErrAmountUnderflow, a, b)
+	}
+	return a - b, nil
+}
+
+// Adds up all amounts, failing if the total does not fit in an Amount.
+func SumAmounts(amounts ...Amount) (Amount, error) {
+	var total Amount = 0
+	for _, amount := range amounts {
+		var err error
+		total, err = total.CheckedAdd(amount)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckedArithmetic(t *testing.T) {
+	if sum, err := Amount(1).CheckedAdd(2); err != nil || sum != 3 {
+		t.Fatalf("1 + 2 returned %d, %v", sum, err)
+	}
+	if _, err := MAX_AMOUNT.CheckedAdd(1); !errors.Is(err, ErrAmountOverflow) {
+		t.Fatalf("MAX_AMOUNT + 1 returned %v, expected ErrAmountOverflow", err)
+	}
+	if _, err := Amount(1).CheckedSub(2); !errors.Is(err, ErrAmountUnderflow) {
+		t.Fatalf("1 - 2 returned %v, expected ErrAmountUnderflow", err)
+	}
+	if _, err := SumAmounts(MAX_AMOUNT/2, MAX_AMOUNT/2, 2); !errors.Is(err, ErrAmountOverflow) {
+		t.Fatalf("SumAmounts returned %v, expected ErrAmountOverflow", err)
+	}
+}
+
+func TestOverflowCannotMint(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 100, address2: MAX_AMOUNT - 10})
+	block := NewBlock(address1, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	stateRoot := block.StateRoot
+
+	// Outputs that wrap around to a small total must not pass as affordable.
+	outputs := []Output{{Address: address2, Amount: MAX_AMOUNT}, {Address: address1, Amount: 2}}
+	tx, _ := NewTransaction(address1, 0, pubKey1, nil, 0, outputs, nil)
+	tx.Sign(privKey1)
+	if _, err := tx.TotalOutput(); !errors.Is(err, ErrAmountOverflow) {
+		t.Fatalf("TotalOutput returned %v, expected ErrAmountOverflow", err)
+	}
+	if block.SufficientFund(tx) || block.AddTransaction(tx) {
+		t.Fatalf("Accepted a transaction whose outputs overflow")
+	}
+
+	// A payment that would push the recipient past MAX_AMOUNT is refused
+	// without debiting the sender either.
+	tx, _ = NewTransaction(address1, 0, pubKey1, nil, 0, []Output{{Address: address2, Amount: 50}}, nil)
+	tx.Sign(privKey1)
+	if block.AddTransaction(tx) {
+		t.Fatalf("Accepted a transaction that overflows the recipient's balance")
+	}
+	if block.BalanceOf(address1) != 100 || block.BalanceOf(address2) != MAX_AMOUNT-10 {
+		t.Fatalf("Rejected transaction changed balances to %d and %d", block.BalanceOf(address1), block.BalanceOf(address2))
+	}
+	if block.StateRoot != stateRoot || len(block.Transactions) != 0 {
+		t.Fatalf("Rejected transaction changed the block")
+	}
+}
+
+func TestAvailableGoldUnderflow(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 100})
+	fakeNet := NewFakeNet()
+	client := NewClient("Alice", fakeNet, genesis, privKey1, config)
+
+	tx, _ := NewTransaction(client.Address, 0, client.PubKey, nil, 1, []Output{{Address: address2, Amount: 49}}, nil)
+	client.PendingOutgoingTransactions[tx.Id()] = tx
+	if available, err := client.AvailableGold(); err != nil || available != 50 {
+		t.Fatalf("AvailableGold returned %d, %v, expected 50", available, err)
+	}
+
+	tx, _ = NewTransaction(client.Address, 1, client.PubKey, nil, 1, []Output{{Address: address2, Amount: 50}}, nil)
+	client.PendingOutgoingTransactions[tx.Id()] = tx
+	if _, err := client.AvailableGold(); !errors.Is(err, ErrAmountUnderflow) {
+		t.Fatalf("AvailableGold returned %v, expected ErrAmountUnderflow", err)
+	}
+}
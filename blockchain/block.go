@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/big"
 	"time"
 )
@@ -14,54 +15,44 @@ type TransactionType struct {
 	Tx Transaction
 }
 
-type NextNonceType struct {
-	Id    string
-	Nonce uint32
-}
-
-type BalanceType struct {
-	Id      string
-	Balance uint32
-}
-
 type Block struct {
-	PrevBlockHash  string
-	Target         big.Int
-	Proof          uint32
-	Balances       []BalanceType
-	NextNonce      []NextNonceType
+	PrevBlockHash string
+	TxRoot        string
+	StateRoot     string
+	Target        big.Int
+	Proof         uint32
+	// Changed by the miner once every Proof has been tried, so that the
+	// search moves on to hashes it has not seen yet.
+	ExtraNonce     uint64
+	Diff           StateDiff
 	Transactions   []TransactionType
 	ChainLength    uint32
 	Timestamp      time.Time
 	RewardAddr     string
-	CoinbaseReward uint32
-}
+	CoinbaseReward Amount
 
-func (block *Block) FindTransactionIndex(id string) int {
-	index := int(-1)
-	for i, v := range block.Transactions {
-		if v.Id == id {
-			index = i
-			break
-		}
-	}
-	return index
-}
+	// Timestamp of the first block in the current retargeting window.
+	// Derived locally like Diff, so it is not part of the hash.
+	WindowStart time.Time
 
-func (block *Block) FindNextNonceIndex(id string) int {
-	index := int(-1)
-	for i, v := range block.NextNonce {
-		if v.Id == id {
-			index = i
-			break
-		}
-	}
-	return index
+	// Total proof-of-work of the chain ending in this block, also derived
+	// locally from the targets of the block and its ancestors.
+	ChainWork big.Int
+
+	// The block Diff applies to, and the state store the diff has been
+	// applied to, if any. Both are local to this node.
+	parent *Block
+	store  *StateStore
+
+	// Set whenever the transactions or the state change. The roots are then
+	// recomputed the next time the header is needed, rather than once per
+	// transaction while a block is being filled.
+	rootsStale bool
 }
 
-func (block *Block) FindBalanceIndex(id string) int {
+func (block *Block) FindTransactionIndex(id string) int {
 	index := int(-1)
-	for i, v := range block.Balances {
+	for i, v := range block.Transactions {
 		if v.Id == id {
 			index = i
 			break
@@ -70,7 +61,7 @@ func (block *Block) FindBalanceIndex(id string) int {
 	return index
 }
 
-func NewBlock(rewardAddr string, prevBlock *Block, target *big.Int, coinbaseReward uint32) *Block {
+func NewBlock(rewardAddr string, prevBlock *Block, target *big.Int, coinbaseReward Amount) *Block {
 	var block Block
 	block.Target = *target
 	block.Proof = 0
@@ -85,53 +76,68 @@ func NewBlock(rewardAddr string, prevBlock *Block, target *big.Int, coinbaseRewa
 		}
 	}
 
-	// copy Balances from previous block
-	block.Balances = make([]BalanceType, 0)
-	if prevBlock != nil && (*prevBlock).Balances != nil {
-		block.Balances = append(block.Balances, (*prevBlock).Balances...)
-	}
+	// Only the accounts this block changes are kept; the rest are read
+	// through the parent.
+	block.parent = prevBlock
 
-	// copy NextNounce from previous block
-	block.NextNonce = make([]NextNonceType, 0)
-	if prevBlock != nil && (*prevBlock).NextNonce != nil {
-		block.NextNonce = append(block.NextNonce, (*prevBlock).NextNonce...)
+	if !block.PayReward(prevBlock) {
+		fmt.Println("Failed to pay the reward of the previous block")
+		return nil
 	}
 
 	block.Transactions = make([]TransactionType, 0)
+	block.rootsStale = true
 
 	block.ChainLength = 0
 	if prevBlock != nil {
 		block.ChainLength = (*prevBlock).ChainLength + 1
 	}
 
+	// Timestamps must increase along the chain, even if our clock is behind
+	// whoever mined the previous block.
 	block.Timestamp = time.Now()
+	if prevBlock != nil && !block.Timestamp.After((*prevBlock).Timestamp) {
+		block.Timestamp = (*prevBlock).Timestamp.Add(time.Nanosecond)
+	}
 	block.RewardAddr = rewardAddr
 	block.CoinbaseReward = coinbaseReward
+	block.SetChainWork(prevBlock)
 	return &block
 }
 
+// Copies the block, so that the copy can be changed while the original is
+// still being mined or read.
+func (block *Block) Clone() *Block {
+	clone := *block
+	clone.Target = big.Int{}
+	clone.Target.Set(&(*block).Target)
+	clone.ChainWork = big.Int{}
+	clone.ChainWork.Set(&(*block).ChainWork)
+	clone.Diff = (*block).Diff.clone()
+	clone.store = nil
+	clone.Transactions = append([]TransactionType{}, (*block).Transactions...)
+	return &clone
+}
+
 func (block *Block) ToString() string {
 	var blockStr string
 
 	blockStr = fmt.Sprintf("PrevBlockHash: %s\n", (*block).PrevBlockHash)
+	blockStr = blockStr + fmt.Sprintf("TxRoot: %s\n", (*block).TxRoot)
+	blockStr = blockStr + fmt.Sprintf("StateRoot: %s\n", (*block).StateRoot)
 	blockStr = blockStr + fmt.Sprintf("Target: %x\n", &(*block).Target)
 	blockStr = blockStr + fmt.Sprintf("Proof: %d\n", (*block).Proof)
+	blockStr = blockStr + fmt.Sprintf("ExtraNonce: %d\n", (*block).ExtraNonce)
 	blockStr = blockStr + fmt.Sprintf("ChainLength: %d\n", (*block).ChainLength)
 	blockStr = blockStr + fmt.Sprintf("Timestamp: %s\n", (*block).Timestamp.GoString())
 	blockStr = blockStr + fmt.Sprintf("RewardAddr: %s\n", (*block).RewardAddr)
 	blockStr = blockStr + fmt.Sprintf("CoinbaseReward: %d\n", (*block).CoinbaseReward)
 
-	balanceStr := "Balancecs: [\n"
-	for _, v := range (*block).Balances {
-		balanceStr = balanceStr + fmt.Sprintf("\t%s: %d\n", v.Id, v.Balance)
-	}
-	balanceStr = balanceStr + "]\n"
-
-	nextNonceStr := "nextNonceStr: [\n"
-	for _, v := range (*block).NextNonce {
-		nextNonceStr = nextNonceStr + fmt.Sprintf("\t%s: %d\n", v.Id, v.Nonce)
+	diffStr := "Changed accounts: [\n"
+	for _, v := range (*block).Diff.Changes {
+		diffStr = diffStr + fmt.Sprintf("\t%s: %d (nonce %d)\n", v.After.Address, v.After.Balance, v.After.Nonce)
 	}
-	nextNonceStr = nextNonceStr + "]\n"
+	diffStr = diffStr + "]\n"
 
 	transactionStr := "Transactions: [\n"
 	for _, v := range (*block).Transactions {
@@ -139,12 +145,13 @@ func (block *Block) ToString() string {
 	}
 	transactionStr = transactionStr + "]\n"
 
-	blockStr = blockStr + balanceStr + nextNonceStr + transactionStr
+	blockStr = blockStr + diffStr + transactionStr
 
 	return blockStr
 }
 
 func BlockToBytes(block *Block) ([]byte, error) {
+	block.refreshRoots()
 	data, err := json.Marshal(block)
 	if err != nil {
 		return nil, err
@@ -160,12 +167,17 @@ func BytesToBlock(data []byte) (*Block, error) {
 	return &block, nil
 }
 
-func (block *Block) GetHash() (string, error) {
-	block4hash := *block
-	block4hash.Balances = nil
-	block4hash.NextNonce = nil
+// Serializes the block header, which is what the block hash is taken over.
+func (block *Block) hashData() ([]byte, error) {
+	header, err := block.Header()
+	if err != nil {
+		return nil, err
+	}
+	return header.MarshalBinary()
+}
 
-	blockData, err := BlockToBytes(&block4hash)
+func (block *Block) GetHash() (string, error) {
+	blockData, err := block.hashData()
 	var blockHash [32]byte
 	if err == nil {
 		blockHash = sha256.Sum256(blockData)
@@ -176,11 +188,7 @@ func (block *Block) GetHash() (string, error) {
 }
 
 func (block *Block) GetHashStr() string {
-	block4hash := *block
-	block4hash.Balances = nil
-	block4hash.NextNonce = nil
-
-	blockData, err := BlockToBytes(&block4hash)
+	blockData, err := block.hashData()
 	var blockHash [32]byte
 	if err == nil {
 		blockHash = sha256.Sum256(blockData)
@@ -190,24 +198,127 @@ func (block *Block) GetHashStr() string {
 	}
 }
 
+// The expected number of hashes needed to find a proof for the block's
+// target, computed as 2^256 / (target + 1) as Bitcoin does.
+func (block *Block) Work() *big.Int {
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, new(big.Int).Add(&(*block).Target, big.NewInt(1)))
+}
+
+// Adds the block's own work to the chain work of its parent.
+func (block *Block) SetChainWork(prevBlock *Block) {
+	(*block).ChainWork.Set(block.Work())
+	if prevBlock != nil {
+		(*block).ChainWork.Add(&(*block).ChainWork, &(*prevBlock).ChainWork)
+	}
+}
+
+// Fork choice rule: a chain only replaces the current head if it carries
+// strictly more total work. On a tie the block seen first stays the head.
+func (block *Block) HasMoreWorkThan(other *Block) bool {
+	return (*block).ChainWork.Cmp(&(*other).ChainWork) > 0
+}
+
+// A proof that a transaction is included in the block with a given hash.
+// It carries the serialized header, so a lightweight wallet can check it
+// without downloading the rest of the block.
+type TxProof struct {
+	TxId   string
+	Branch []MerkleStep
+	Header []byte
+}
+
+// The Merkle tree leaves are the transaction ids, in block order.
+func (block *Block) txLeaves() [][]byte {
+	leaves := make([][]byte, len((*block).Transactions))
+	for i, v := range (*block).Transactions {
+		leaves[i], _ = hex.DecodeString(v.Id)
+	}
+	return leaves
+}
+
+// Computes the Merkle root over the ids of the block's transactions.
+func (block *Block) ComputeTxRoot() string {
+	return hex.EncodeToString(MerkleRoot(block.txLeaves()))
+}
+
+// Recommits the header to the block's current transactions and state.
+func (block *Block) updateRoots() {
+	(*block).TxRoot = block.ComputeTxRoot()
+	(*block).StateRoot = block.ComputeStateRoot()
+	(*block).rootsStale = false
+}
+
+// Brings the roots up to date if the block changed since they were last
+// computed. Everything that reads the header goes through here, so a block
+// is never hashed or sent with stale roots.
+func (block *Block) refreshRoots() {
+	if (*block).rootsStale {
+		block.updateRoots()
+	}
+}
+
+func (block *Block) ProveTransaction(txId string) (*TxProof, error) {
+	index := block.FindTransactionIndex(txId)
+	if index == -1 {
+		return nil, fmt.Errorf("transaction %s is not in the block", txId)
+	}
+	header, err := block.hashData()
+	if err != nil {
+		return nil, err
+	}
+	return &TxProof{TxId: txId, Branch: MerkleBranch(block.txLeaves(), index), Header: header}, nil
+}
+
+// Decodes the header carried by a proof, provided it hashes to headerHash.
+func decodeProofHeader(headerHash string, data []byte) (*BlockHeader, bool) {
+	var header BlockHeader
+	if err := header.UnmarshalBinary(data); err != nil {
+		return nil, false
+	}
+	hashed := header.Hash()
+	if hex.EncodeToString(hashed[:]) != headerHash {
+		return nil, false
+	}
+	return &header, true
+}
+
+// Checks that the proof connects its transaction to the block hash.
+func VerifyTxProof(headerHash string, proof *TxProof) bool {
+	header, ok := decodeProofHeader(headerHash, (*proof).Header)
+	if !ok {
+		return false
+	}
+	txId, err := hex.DecodeString((*proof).TxId)
+	if err != nil {
+		return false
+	}
+	return VerifyMerkleBranch(txId, (*proof).Branch, (*header).TxRoot[:])
+}
+
+// Moves the block past the proofs a search has covered. When the whole
+// 32-bit proof space is used up, the extra nonce is bumped and the proof
+// starts over, which gives the header a different hash for every proof.
+func (block *Block) AdvanceProof(next uint64) {
+	if next > math.MaxUint32 {
+		(*block).ExtraNonce++
+		(*block).Proof = 0
+	} else {
+		(*block).Proof = uint32(next)
+	}
+}
+
 func (block *Block) IsGenesisBlock() bool {
 	return block.ChainLength == 0
 }
 
 func (block *Block) hasValidProof() bool {
-	block4hash := *block
-	block4hash.Balances = nil
-	block4hash.NextNonce = nil
-	data, err := BlockToBytes(&block4hash)
+	search, err := block.NewProofSearch()
 	if err != nil {
 		fmt.Printf("Failed to convert Block to Byte array")
 		return false
 	}
-	block_hash := sha256.Sum256(data)
-	block_value := big.NewInt(0)
-	block_value.SetBytes(block_hash[:])
-
-	return block_value.Cmp(&(*block).Target) < 0
+	return search.Check((*block).Proof)
 }
 
 func (block *Block) AddTransaction(tx *Transaction) bool {
@@ -225,13 +336,9 @@ func (block *Block) AddTransaction(tx *Transaction) bool {
 		return false
 	}
 
-	nextNonceIndex := block.FindNextNonceIndex((*tx).Info.From)
-	if nextNonceIndex == -1 {
-		addNextNonce := NextNonceType{Id: (*tx).Info.From, Nonce: 0}
-		(*block).NextNonce = append((*block).NextNonce, addNextNonce)
-		nextNonceIndex = len((*block).NextNonce) - 1
-	}
-	expectedNonce := (*block).NextNonce[nextNonceIndex].Nonce
+	// The nonce is only bumped once the transaction is accepted, since a
+	// rejected transaction must leave the committed state untouched.
+	expectedNonce := block.NonceOf((*tx).Info.From)
 
 	if expectedNonce > (*tx).Info.Nonce {
 		fmt.Printf("Replayed transaction %s", tx.Id())
@@ -240,28 +347,44 @@ func (block *Block) AddTransaction(tx *Transaction) bool {
 		fmt.Printf("Out of order transaction %s", tx.Id())
 		return false
 	}
-	var nextNonce uint32 = expectedNonce + 1
-	(*block).NextNonce[nextNonceIndex].Nonce = nextNonce
+
+	// Work out every new balance before touching any of them, so that a
+	// transaction that would overflow a balance is rejected as a whole.
+	totalOutput, err := tx.TotalOutput()
+	if err != nil {
+		fmt.Printf("Invalid amounts in transaction %s: %v", tx.Id(), err)
+		return false
+	}
+	senderBalance, err := block.BalanceOf((*tx).Info.From).CheckedSub(totalOutput)
+	if err != nil {
+		fmt.Printf("Insufficient fund for transaction %s", tx.Id())
+		return false
+	}
+	newBalances := map[string]Amount{(*tx).Info.From: senderBalance}
+	for _, output := range (*tx).Info.Outputs {
+		oldBalance, ok := newBalances[output.Address]
+		if !ok {
+			oldBalance = block.BalanceOf(output.Address)
+		}
+		newBalances[output.Address], err = oldBalance.CheckedAdd(output.Amount)
+		if err != nil {
+			fmt.Printf("Invalid amounts in transaction %s: %v", tx.Id(), err)
+			return false
+		}
+	}
 
 	var txId string = tx.Id()
 	txData := TransactionType{Id: txId, Tx: *tx}
 	(*block).Transactions = append((*block).Transactions, txData)
 
-	var senderBalance uint32 = block.BalanceOf((*tx).Info.From)
-	senderBalanceIndex := block.FindBalanceIndex((*tx).Info.From)
-	(*block).Balances[senderBalanceIndex].Balance = senderBalance - tx.TotalOutput()
-
+	// Apply the sender first and then the outputs, in transaction order, so
+	// the diff lists the accounts in the same order on every node.
+	block.setAccount(AccountState{Address: (*tx).Info.From, Balance: newBalances[(*tx).Info.From], Nonce: expectedNonce + 1})
 	for _, output := range (*tx).Info.Outputs {
-		var oldBalance uint32 = (*block).BalanceOf(output.Address)
-		oldBalanceId := block.FindBalanceIndex(output.Address)
-		if oldBalanceId == -1 {
-			balanceAcct := BalanceType{Id: output.Address, Balance: oldBalance + output.Amount}
-			(*block).Balances = append((*block).Balances, balanceAcct)
-		} else {
-			(*block).Balances[oldBalanceId].Balance = oldBalance + output.Amount
-		}
+		block.setBalance(output.Address, newBalances[output.Address])
 	}
 
+	(*block).rootsStale = true
 	return true
 }
 
@@ -271,30 +394,14 @@ func (block *Block) Rerun(prevBlock *Block) bool {
 		return false
 	}
 
-	// copy Balances from previous block
-	block.Balances = make([]BalanceType, 0)
-	if prevBlock != nil && (*prevBlock).Balances != nil {
-		block.Balances = append(block.Balances, (*prevBlock).Balances...)
-	}
+	(*block).parent = prevBlock
+	(*block).Diff = StateDiff{}
 
-	// copy NextNounce from previous block
-	block.NextNonce = make([]NextNonceType, 0)
-	if prevBlock != nil && (*prevBlock).NextNonce != nil {
-		block.NextNonce = append(block.NextNonce, (*prevBlock).NextNonce...)
+	if !block.PayReward(prevBlock) {
+		return false
 	}
 
-	// Adding coinbase reward for previous block
-	if (*prevBlock).RewardAddr != "" {
-		var winnerBalance uint32 = (*prevBlock).BalanceOf((*prevBlock).RewardAddr)
-		index := block.FindBalanceIndex((*prevBlock).RewardAddr)
-
-		if index == -1 {
-			newBalance := BalanceType{Id: (*prevBlock).RewardAddr, Balance: winnerBalance + prevBlock.CoinbaseReward}
-			(*block).Balances = append((*block).Balances, newBalance)
-		} else {
-			(*block).Balances[index].Balance = winnerBalance + prevBlock.CoinbaseReward
-		}
-	}
+	block.SetChainWork(prevBlock)
 
 	// Re-enter all transactions
 	txMap := make([]TransactionType, len((*block).Transactions))
@@ -305,30 +412,89 @@ func (block *Block) Rerun(prevBlock *Block) bool {
 			return false
 		}
 	}
+	block.updateRoots()
 	return true
 }
 
-func (block *Block) BalanceOf(address string) uint32 {
-	index := block.FindBalanceIndex(address)
-	if index > -1 {
-		return block.Balances[index].Balance
-	} else {
-		return 0
+// Consensus rule for block rewards: the winner of a block earns its coinbase
+// reward plus the fees of every transaction it includes. Since the fees are
+// only known once the block is complete, the payout is credited to the winner
+// in the following block, before that block's own transactions run.
+func (block *Block) PayReward(prevBlock *Block) bool {
+	if prevBlock == nil || (*prevBlock).RewardAddr == "" {
+		return true
+	}
+
+	rewards, err := prevBlock.TotalRewards()
+	if err != nil {
+		return false
+	}
+	winnerBalance, err := block.BalanceOf((*prevBlock).RewardAddr).CheckedAdd(rewards)
+	if err != nil {
+		return false
+	}
+	block.setBalance((*prevBlock).RewardAddr, winnerBalance)
+	return true
+}
+
+// The account's state as of this block, and whether the account exists yet.
+// The diffs of the block and its ancestors are searched until one of them
+// has been applied to a state store, which holds everything older.
+func (block *Block) accountState(address string) (AccountState, bool) {
+	for b := block; b != nil; b = (*b).parent {
+		if (*b).store != nil {
+			return (*b).store.accountAt(b, address)
+		}
+		if change, ok := (*b).Diff.lookup(address); ok {
+			return (*change).After, true
+		}
+	}
+	return AccountState{Address: address}, false
+}
+
+func (block *Block) BalanceOf(address string) Amount {
+	account, _ := block.accountState(address)
+	return account.Balance
+}
+
+// The nonce that the address's next transaction must use.
+func (block *Block) NonceOf(address string) uint32 {
+	account, _ := block.accountState(address)
+	return account.Nonce
+}
+
+func (block *Block) setAccount(account AccountState) {
+	var before AccountState
+	existed := false
+	if (*block).parent != nil {
+		before, existed = (*block).parent.accountState(account.Address)
 	}
+	(*block).Diff.set(account, before, existed)
+	(*block).rootsStale = true
+}
+
+func (block *Block) setBalance(address string, balance Amount) {
+	account, _ := block.accountState(address)
+	account.Balance = balance
+	block.setAccount(account)
 }
 
 func (block *Block) SufficientFund(tx *Transaction) bool {
-	var totalOutput uint32 = (*tx).TotalOutput()
+	totalOutput, err := (*tx).TotalOutput()
+	if err != nil {
+		return false
+	}
 	return totalOutput <= (*block).BalanceOf(tx.Info.From)
 }
 
-func (block *Block) TotalRewards() uint32 {
-	var total uint32 = 0
+// The coinbase reward plus the fees of all transactions in the block.
+func (block *Block) TotalRewards() (Amount, error) {
+	amounts := make([]Amount, 0, len((*block).Transactions)+1)
 	for _, v := range (*block).Transactions {
-		total += v.Tx.Info.Fee
+		amounts = append(amounts, v.Tx.Info.Fee)
 	}
-	total += (*block).CoinbaseReward
-	return total
+	amounts = append(amounts, (*block).CoinbaseReward)
+	return SumAmounts(amounts...)
 }
 
 func (block *Block) Contains(tx *Transaction) bool {
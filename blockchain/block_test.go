@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"math/big"
 	"testing"
+	"time"
 )
 
 func TestGenesisBlock(t *testing.T) {
@@ -12,7 +14,7 @@ func TestGenesisBlock(t *testing.T) {
 	address1 := GenerateAddress(pubKey1)
 	address2 := GenerateAddress(pubKey2)
 
-	newBalances := map[string]uint32{address1: 100, address2: 100}
+	newBalances := map[string]Amount{address1: 100, address2: 100}
 
 	genesis, _, _ := MakeGenesisDefault(newBalances)
 	if genesis == nil {
@@ -33,7 +35,7 @@ func TestNewBlock(t *testing.T) {
 	address1 := GenerateAddress(pubKey1)
 	address2 := GenerateAddress(pubKey2)
 
-	newBalances := map[string]uint32{address1: 100, address2: 100}
+	newBalances := map[string]Amount{address1: 100, address2: 100}
 
 	genesis, config, _ := MakeGenesisDefault(newBalances)
 	if genesis == nil {
@@ -63,7 +65,7 @@ func TestAddTransaction(t *testing.T) {
 	address2 := GenerateAddress(pubKey2)
 	address3 := GenerateAddress(pubKey3)
 
-	newBalances := map[string]uint32{address1: 1000, address2: 1000, address3: 1000}
+	newBalances := map[string]Amount{address1: 1000, address2: 1000, address3: 1000}
 
 	genesis, config, _ := MakeGenesisDefault(newBalances)
 	if genesis == nil {
@@ -111,7 +113,7 @@ func TestVerifyProof(t *testing.T) {
 	address2 := GenerateAddress(pubKey2)
 	address3 := GenerateAddress(pubKey3)
 
-	newBalances := map[string]uint32{address1: 1000, address2: 1000, address3: 1000}
+	newBalances := map[string]Amount{address1: 1000, address2: 1000, address3: 1000}
 
 	genesis, config, _ := MakeGenesisDefault(newBalances)
 	if genesis == nil {
@@ -164,3 +166,255 @@ func TestVerifyProof(t *testing.T) {
 	}
 
 }
+
+func TestNextTarget(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	config.adjustmentWindow = 4
+	config.targetBlockInterval = 10 * time.Second
+
+	// Builds a chain where every block arrives the given time after its parent.
+	extend := func(prevBlock *Block, count int, spacing time.Duration) *Block {
+		for i := 0; i < count; i++ {
+			block := NewBlock("", prevBlock, config.NextTarget(prevBlock), config.coinbaseAmount)
+			block.Timestamp = prevBlock.Timestamp.Add(spacing)
+			config.SetWindowStart(block, prevBlock)
+			prevBlock = block
+		}
+		return prevBlock
+	}
+
+	// Heights 1..4 form the first window, so the target cannot change yet.
+	fast := extend(genesis, 4, 5*time.Second)
+	if fast.Target.Cmp(&genesis.Target) != 0 {
+		t.Fatalf("Target changed inside the first window")
+	}
+
+	// Blocks arrived twice as fast as intended, so the target halves.
+	expected := new(big.Int).Div(&genesis.Target, big.NewInt(2))
+	if next := config.NextTarget(fast); next.Cmp(expected) != 0 {
+		t.Fatalf("Expected target %x, got %x", expected, next)
+	}
+
+	// A very slow window is clamped to MAX_RETARGET_FACTOR.
+	slow := extend(genesis, 4, time.Hour)
+	expected = new(big.Int).Mul(&genesis.Target, big.NewInt(MAX_RETARGET_FACTOR))
+	if next := config.NextTarget(slow); next.Cmp(expected) != 0 {
+		t.Fatalf("Expected target %x, got %x", expected, next)
+	}
+
+	// Inside the following window the new target is carried over.
+	next := extend(fast, 2, 10*time.Second)
+	if config.NextTarget(next).Cmp(&next.Target) != 0 {
+		t.Fatalf("Target changed inside a window")
+	}
+}
+
+func TestChainWork(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+
+	// Two easy blocks against one block that is eight times harder.
+	easyTarget := CalculateTarget(POW_LEADING_ZEROES)
+	hardTarget := CalculateTarget(POW_LEADING_ZEROES + 3)
+	easy1 := NewBlock("", genesis, easyTarget, config.coinbaseAmount)
+	easy2 := NewBlock("", easy1, easyTarget, config.coinbaseAmount)
+	hard1 := NewBlock("", genesis, hardTarget, config.coinbaseAmount)
+
+	if easy2.ChainLength <= hard1.ChainLength {
+		t.Fatalf("Expected the easy chain to be longer")
+	}
+	if !hard1.HasMoreWorkThan(easy2) || easy2.HasMoreWorkThan(hard1) {
+		t.Fatalf("Expected the shorter but harder chain to have more work")
+	}
+
+	// Equal work is not enough to replace the head.
+	tied := NewBlock("", easy1, easyTarget, config.coinbaseAmount)
+	if tied.HasMoreWorkThan(easy2) || easy2.HasMoreWorkThan(tied) {
+		t.Fatalf("Expected blocks at the same height and target to tie")
+	}
+
+	// Rerun derives the chain work again instead of trusting the sender.
+	easy2.ChainWork.SetInt64(0)
+	easy2.Rerun(easy1)
+	if easy2.ChainWork.Cmp(&tied.ChainWork) != 0 {
+		t.Fatalf("Rerun did not restore the chain work")
+	}
+}
+
+func TestGenesisHashPinned(t *testing.T) {
+	_, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+
+	// Independently built genesis blocks must agree on their hash.
+	genesis1, config1, _ := MakeGenesisDefault(map[string]Amount{address1: 100, address2: 200})
+	genesis2, config2, _ := MakeGenesisDefault(map[string]Amount{address2: 200, address1: 100})
+	if config1.genesisHash != genesis1.GetHashStr() || config1.genesisHash != config2.genesisHash {
+		t.Fatalf("Genesis hash is not deterministic")
+	}
+
+	// The starting balances are committed to the hash.
+	genesis2.Diff.Changes[0].After.Balance = 1000
+	if genesis2.ValidateGenesis(config1) == nil {
+		t.Fatalf("Genesis block with different balances has the same hash")
+	}
+}
+
+func TestFeesPaidToWinner(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	_, pubKey3, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	winner := GenerateAddress(pubKey3)
+
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 1000, address2: 500})
+
+	totalSupply := func(block *Block) Amount {
+		var total Amount = 0
+		for _, v := range block.Accounts() {
+			total += v.Balance
+		}
+		return total
+	}
+	genesisSupply := totalSupply(genesis)
+
+	// Every block pays fees from address1 and is won by the same miner.
+	var issued Amount = 0
+	var fees Amount = 0
+	prevBlock := genesis
+	for nonce := uint32(0); nonce < 5; nonce++ {
+		block := NewBlock(winner, prevBlock, config.NextTarget(prevBlock), config.coinbaseAmount)
+
+		// Once the previous block's rewards are credited, the supply equals
+		// the genesis allocations plus all coinbase issued so far.
+		if totalSupply(block) != genesisSupply+issued {
+			t.Fatalf("Supply at height %d is %d, expected %d", block.ChainLength, totalSupply(block), genesisSupply+issued)
+		}
+		if block.BalanceOf(winner) != issued+fees {
+			t.Fatalf("Winner has %d, expected %d", block.BalanceOf(winner), issued+fees)
+		}
+
+		tx, _ := NewTransaction(address1, nonce, pubKey1, nil, 3, []Output{{Address: address2, Amount: 10}}, nil)
+		tx.Sign(privKey1)
+		if !block.AddTransaction(tx) {
+			t.Fatalf("Failed to add transaction %d", nonce)
+		}
+
+		issued += block.CoinbaseReward
+		fees += tx.Info.Fee
+		prevBlock = block
+	}
+
+	// Rerun must arrive at the same balances as the block's author.
+	last := NewBlock(winner, prevBlock, config.NextTarget(prevBlock), config.coinbaseAmount)
+	replayed := *last
+	replayed.Rerun(prevBlock)
+	if replayed.BalanceOf(winner) != issued+fees || totalSupply(&replayed) != genesisSupply+issued {
+		t.Fatalf("Rerun credited %d to the winner, expected %d", replayed.BalanceOf(winner), issued+fees)
+	}
+}
+
+func TestProveTransaction(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 1000})
+
+	block := NewBlock(address2, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	for nonce := uint32(0); nonce < 5; nonce++ {
+		tx, _ := NewTransaction(address1, nonce, pubKey1, nil, config.defaultTxFee, []Output{{Address: address2, Amount: 10}}, nil)
+		tx.Sign(privKey1)
+		block.AddTransaction(tx)
+	}
+	blockHash := block.GetHashStr()
+
+	for _, v := range block.Transactions {
+		proof, err := block.ProveTransaction(v.Id)
+		if err != nil {
+			t.Fatalf("ProveTransaction() Error: %v", err)
+		}
+		if !VerifyTxProof(blockHash, proof) {
+			t.Fatalf("Proof for transaction %s does not verify", v.Id)
+		}
+		if VerifyTxProof(genesis.GetHashStr(), proof) {
+			t.Fatalf("Proof verifies against the wrong block")
+		}
+	}
+
+	// A proof cannot be reused for a transaction that is not in the block.
+	proof, _ := block.ProveTransaction(block.Transactions[0].Id)
+	proof.TxId = genesis.GetHashStr()
+	if VerifyTxProof(blockHash, proof) {
+		t.Fatalf("Proof verifies a transaction that is not in the block")
+	}
+
+	if _, err := block.ProveTransaction(genesis.GetHashStr()); err == nil {
+		t.Fatalf("Proved a transaction that is not in the block")
+	}
+}
+
+// Builds a block on prevBlock with the given transactions and finds a proof
+// for it.
+func minedBlock(t *testing.T, prevBlock *Block, config BlockchainConfig, winner string, txs ...*Transaction) *Block {
+	t.Helper()
+	block := NewBlock(winner, prevBlock, config.NextTarget(prevBlock), config.SubsidyAt(prevBlock.ChainLength+1))
+	config.SetWindowStart(block, prevBlock)
+	for _, tx := range txs {
+		if !block.AddTransaction(tx) {
+			t.Fatalf("Transaction %s was rejected", tx.Id())
+		}
+	}
+	header, err := block.Header()
+	if err != nil {
+		t.Fatalf("Header() Error: %v", err)
+	}
+	block.Proof = mineHeader(t, header)
+	return block
+}
+
+// Finds a proof for a block header, such as one handed out in a template.
+func mineHeader(t *testing.T, header *BlockHeader) uint32 {
+	t.Helper()
+	result := header.NewProofSearch().Run(0, 1<<24, DefaultMiningOptions(), nil)
+	if !result.Found {
+		t.Fatalf("No proof found")
+	}
+	return result.Proof
+}
+
+// Mines the node's own templates until its head reaches height.
+func mineTemplates(t *testing.T, node *TcpMiner, height uint32) {
+	t.Helper()
+	node.mu.Lock()
+	next := node.LastBlock.ChainLength + 1
+	node.mu.Unlock()
+	for ; next <= height; next++ {
+		template, err := node.GetBlockTemplate()
+		if err != nil {
+			t.Fatalf("GetBlockTemplate() Error: %v", err)
+		}
+		var header BlockHeader
+		header.UnmarshalBinary(template.Header)
+		if err := node.SubmitBlock(template.Header, mineHeader(t, &header)); err != nil {
+			t.Fatalf("SubmitBlock() Error: %v", err)
+		}
+		waitForHeight(t, node, next)
+	}
+}
+
+// Waits for the node to adopt a head at the given height.
+func waitForHeight(t *testing.T, node *TcpMiner, height uint32) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		node.mu.Lock()
+		length := node.LastBlock.ChainLength
+		node.mu.Unlock()
+		if length >= height {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Node did not reach height %d", height)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"math/big"
+	"sort"
+	"time"
 )
 
 // Network message constants
@@ -17,30 +20,57 @@ const NUM_ROUNDS_MINING uint32 = 2000
 const POW_BASE_TARGET_STR string = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
 const POW_LEADING_ZEROES uint32 = 15
 
+// Constants for difficulty retargeting. The target is recalculated at the
+// start of every ADJUSTMENT_WINDOW blocks so that blocks keep arriving about
+// once per TARGET_BLOCK_INTERVAL, no matter how many miners are online.
+// A single retarget never moves the target by more than MAX_RETARGET_FACTOR.
+const TARGET_BLOCK_INTERVAL time.Duration = 10 * time.Second
+const ADJUSTMENT_WINDOW uint32 = 20
+const MAX_RETARGET_FACTOR int64 = 4
+
 // Constants for mining rewards and default transaction fees
-const COINBASE_AMT_ALLOWED uint32 = 25
-const DEFAULT_TX_FEE uint32 = 1
+const COINBASE_AMT_ALLOWED Amount = 25
+const DEFAULT_TX_FEE Amount = 1
+
+// The coinbase reward halves every HALVING_INTERVAL blocks. A non-zero
+// MAX_COINBASE_SUPPLY caps the total amount ever issued through coinbase
+// rewards, not counting the genesis allocations.
+const HALVING_INTERVAL uint32 = 10000
+const MAX_COINBASE_SUPPLY Amount = 0
 
 // If a block is 6 blocks older than the current block, it is considered
 // confirmed, for no better reason than that is what Bitcoin does.
 // Note that the genesis block is always considered to be confirmed.
 const CONFIRMED_DEPTH uint32 = 6
 
+// Every node builds its own genesis block, so it must not depend on the local
+// clock or on map iteration order for all of them to agree on its hash.
+var GENESIS_TIMESTAMP = time.Date(2022, time.May, 1, 0, 0, 0, 0, time.UTC)
+
 type BlockchainConfig struct {
-	coinbaseAmount uint32
-	defaultTxFee   uint32
-	confirmedDepth uint32
+	coinbaseAmount      Amount
+	halvingInterval     uint32
+	maxCoinbaseSupply   Amount
+	defaultTxFee        Amount
+	confirmedDepth      uint32
+	targetBlockInterval time.Duration
+	adjustmentWindow    uint32
+	genesisHash         string
 }
 
-func MakeGenesisDefault(startingBalances map[string]uint32) (*Block, BlockchainConfig, error) {
+func MakeGenesisDefault(startingBalances map[string]Amount) (*Block, BlockchainConfig, error) {
 	return MakeGenesis(POW_LEADING_ZEROES, COINBASE_AMT_ALLOWED, DEFAULT_TX_FEE, CONFIRMED_DEPTH, startingBalances)
 }
 
-func MakeGenesis(leading_zeros uint32, coinbase_amt uint32, tx_fee uint32, confirmed_depth uint32, starting_balances map[string]uint32) (*Block, BlockchainConfig, error) {
+func MakeGenesis(leading_zeros uint32, coinbase_amt Amount, tx_fee Amount, confirmed_depth uint32, starting_balances map[string]Amount) (*Block, BlockchainConfig, error) {
 	var newconfig BlockchainConfig
 	newconfig.coinbaseAmount = coinbase_amt
+	newconfig.halvingInterval = HALVING_INTERVAL
+	newconfig.maxCoinbaseSupply = MAX_COINBASE_SUPPLY
 	newconfig.confirmedDepth = confirmed_depth
 	newconfig.defaultTxFee = tx_fee
+	newconfig.targetBlockInterval = TARGET_BLOCK_INTERVAL
+	newconfig.adjustmentWindow = ADJUSTMENT_WINDOW
 
 	if starting_balances == nil {
 		return nil, newconfig, errors.New("makeGenesis(...): starting_balances cannot be nil")
@@ -49,10 +79,128 @@ func MakeGenesis(leading_zeros uint32, coinbase_amt uint32, tx_fee uint32, confi
 	target := CalculateTarget(leading_zeros)
 	newblock := NewBlock("", nil, target, coinbase_amt)
 
-	for k, v := range starting_balances {
-		newBalance := BalanceType{Id: k, Balance: v}
-		(*newblock).Balances = append((*newblock).Balances, newBalance)
+	(*newblock).Timestamp = GENESIS_TIMESTAMP
+
+	addresses := make([]string, 0, len(starting_balances))
+	for k := range starting_balances {
+		addresses = append(addresses, k)
 	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		newblock.setBalance(address, starting_balances[address])
+	}
+	newblock.updateRoots()
+	newconfig.SetWindowStart(newblock, nil)
+	newblock.SetChainWork(nil)
+
+	// Pin the genesis block, which commits to the starting balances.
+	genesisHash, err := newblock.GetHash()
+	if err != nil {
+		return nil, newconfig, err
+	}
+	newconfig.genesisHash = genesisHash
 
 	return newblock, newconfig, nil
 }
+
+// Retargeting windows cover the heights 1..W, W+1..2W and so on. The genesis
+// block does not belong to any window, since its timestamp says nothing about
+// how fast the network mines.
+func (config *BlockchainConfig) isWindowStart(chainLength uint32) bool {
+	window := (*config).adjustmentWindow
+	return window > 1 && chainLength > 0 && (chainLength-1)%window == 0
+}
+
+// Records when the retargeting window containing the block began.
+func (config *BlockchainConfig) SetWindowStart(block *Block, prevBlock *Block) {
+	if prevBlock == nil || config.isWindowStart((*block).ChainLength) {
+		(*block).WindowStart = (*block).Timestamp
+	} else {
+		(*block).WindowStart = (*prevBlock).WindowStart
+	}
+}
+
+// Calculates the target that the block following prevBlock must use.
+// Inside a window the target is carried over unchanged. At the start of a new
+// window it is scaled by the time the previous window actually took compared
+// to the time it should have taken.
+func (config *BlockchainConfig) NextTarget(prevBlock *Block) *big.Int {
+	target := new(big.Int).Set(&(*prevBlock).Target)
+	chainLength := (*prevBlock).ChainLength + 1
+	if chainLength == 1 || !config.isWindowStart(chainLength) || (*config).targetBlockInterval <= 0 {
+		return target
+	}
+
+	// The previous window spans adjustmentWindow blocks, so its first and
+	// last timestamps are adjustmentWindow-1 intervals apart.
+	expected := int64((*config).targetBlockInterval) * int64((*config).adjustmentWindow-1)
+	actual := int64((*prevBlock).Timestamp.Sub((*prevBlock).WindowStart))
+	if actual < expected/MAX_RETARGET_FACTOR {
+		actual = expected / MAX_RETARGET_FACTOR
+	}
+	if actual > expected*MAX_RETARGET_FACTOR {
+		actual = expected * MAX_RETARGET_FACTOR
+	}
+
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	maxTarget := CalculateTarget(0)
+	if target.Cmp(maxTarget) > 0 {
+		target.Set(maxTarget)
+	}
+	if target.Sign() == 0 {
+		target.SetInt64(1)
+	}
+	return target
+}
+
+// Changes the emission schedule: the coinbase reward of the first block, the
+// number of blocks after which it halves (0 never halves), and the cap on
+// the total coinbase issued (0 for no cap).
+func (config *BlockchainConfig) SetEmissionSchedule(initialSubsidy Amount, halvingInterval uint32, maxCoinbaseSupply Amount) {
+	(*config).coinbaseAmount = initialSubsidy
+	(*config).halvingInterval = halvingInterval
+	(*config).maxCoinbaseSupply = maxCoinbaseSupply
+}
+
+// Total coinbase issued by the blocks at heights 1 through chainLength.
+// The genesis block has no winner, so it never issues a reward. A schedule
+// that would issue more than an Amount can hold saturates at MAX_AMOUNT.
+func (config *BlockchainConfig) IssuedAt(chainLength uint32) Amount {
+	var issued Amount = 0
+	remaining := Amount(chainLength)
+	subsidy := (*config).coinbaseAmount
+	for remaining > 0 && subsidy > 0 {
+		blocks := remaining
+		if (*config).halvingInterval > 0 && blocks > Amount((*config).halvingInterval) {
+			blocks = Amount((*config).halvingInterval)
+		}
+		var err error
+		if subsidy > MAX_AMOUNT/blocks {
+			err = ErrAmountOverflow
+		} else {
+			issued, err = issued.CheckedAdd(blocks * subsidy)
+		}
+		if err != nil {
+			issued = MAX_AMOUNT
+			break
+		}
+		remaining -= blocks
+		subsidy >>= 1
+	}
+
+	if (*config).maxCoinbaseSupply > 0 && issued > (*config).maxCoinbaseSupply {
+		issued = (*config).maxCoinbaseSupply
+	}
+	return issued
+}
+
+// Coinbase reward that the block at the given height must claim. Near the
+// cap the last reward is cut short so the cap is hit exactly.
+func (config *BlockchainConfig) SubsidyAt(chainLength uint32) Amount {
+	if chainLength == 0 {
+		return 0
+	}
+	return config.IssuedAt(chainLength) - config.IssuedAt(chainLength-1)
+}
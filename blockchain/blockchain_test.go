@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEmissionSchedule(t *testing.T) {
+	_, config, _ := MakeGenesisDefault(map[string]Amount{})
+	config.SetEmissionSchedule(50, 10, 0)
+
+	expected := map[uint32]Amount{0: 0, 1: 50, 10: 50, 11: 25, 20: 25, 21: 12, 31: 6, 61: 0, 1000: 0}
+	for height, subsidy := range expected {
+		if config.SubsidyAt(height) != subsidy {
+			t.Fatalf("Subsidy at height %d is %d, expected %d", height, config.SubsidyAt(height), subsidy)
+		}
+	}
+	if config.IssuedAt(20) != 750 {
+		t.Fatalf("Issued at height 20 is %d, expected 750", config.IssuedAt(20))
+	}
+
+	// The issued amount must always equal the sum of the block subsidies.
+	var total Amount = 0
+	for height := uint32(1); height <= 100; height++ {
+		total += config.SubsidyAt(height)
+		if config.IssuedAt(height) != total {
+			t.Fatalf("Issued at height %d is %d, expected %d", height, config.IssuedAt(height), total)
+		}
+	}
+
+	// With a cap, the reward is cut short at the block that reaches it.
+	config.SetEmissionSchedule(50, 0, 120)
+	if config.SubsidyAt(2) != 50 || config.SubsidyAt(3) != 20 || config.SubsidyAt(4) != 0 {
+		t.Fatalf("Subsidies do not stop at the cap")
+	}
+	if config.IssuedAt(1000) != 120 {
+		t.Fatalf("Issued %d, expected the cap of 120", config.IssuedAt(1000))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const BLOCK_STORE_FILE string = "blocks.dat"
+
+// Every record starts with this, then the length and CRC-32 of the block's
+// binary encoding.
+const BLOCK_STORE_MAGIC uint32 = 0x53474231 // "SGB1"
+const BLOCK_STORE_RECORD_HEADER int = 12
+
+// Records larger than this are treated as corruption rather than read.
+const BLOCK_STORE_MAX_RECORD uint32 = 64 << 20
+
+// With SYNC_BATCHED, the file is synced after this many appends.
+const BLOCK_STORE_SYNC_BATCH int = 16
+
+// When appended blocks are forced to disk. Whatever the policy, a block lost
+// in a crash is only cut off the end of the file, which recovery removes.
+type SyncPolicy int
+
+const (
+	SYNC_EVERY_BLOCK SyncPolicy = iota
+	SYNC_BATCHED
+	SYNC_NEVER
+)
+
+var ErrBlockNotStored = errors.New("block is not in the store")
+var ErrStoreEncoding = errors.New("block store holds a block this node cannot decode")
+
+// Append-only file of accepted blocks, indexed in memory by hash and height.
+// Blocks are only appended after their parent, so replaying the file in order
+// always finds each parent first.
+type BlockStore struct {
+	dir      string
+	file     *os.File
+	size     int64
+	byHash   map[string]int64
+	byHeight map[uint32][]string
+	order    []string
+	policy   SyncPolicy
+	unsynced int
+	mu       sync.Mutex
+}
+
+// Opens the store in dir, creating it if needed. A torn or corrupt record at
+// the end of the file, as left by a crash, is cut off along with anything
+// after it. An intact record this node cannot decode fails with
+// ErrStoreEncoding instead.
+func OpenBlockStore(dir string, policy SyncPolicy) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, BLOCK_STORE_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var s BlockStore
+	s.dir = dir
+	s.file = file
+	s.byHash = make(map[string]int64)
+	s.byHeight = make(map[uint32][]string)
+	s.policy = policy
+	if err := s.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Reads a record at offset, returning the block and the record's length.
+func (s *BlockStore) readRecord(offset int64) (*Block, int64, error) {
+	header := make([]byte, BLOCK_STORE_RECORD_HEADER)
+	if _, err := (*s).file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != BLOCK_STORE_MAGIC {
+		return nil, 0, fmt.Errorf("%w: bad record magic at offset %d", ErrBadEncoding, offset)
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > BLOCK_STORE_MAX_RECORD {
+		return nil, 0, fmt.Errorf("%w: record of %d bytes at offset %d", ErrBadEncoding, length, offset)
+	}
+	data := make([]byte, length)
+	if _, err := (*s).file.ReadAt(data, offset+int64(BLOCK_STORE_RECORD_HEADER)); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[8:12]) {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch at offset %d", ErrBadEncoding, offset)
+	}
+	// The record is intact, so a block that does not decode was written in
+	// another encoding version. It is not cut off like a torn write.
+	var block Block
+	if err := block.UnmarshalBinary(data); err != nil {
+		return nil, 0, fmt.Errorf("%w at offset %d: %v", ErrStoreEncoding, offset, err)
+	}
+	return &block, int64(BLOCK_STORE_RECORD_HEADER) + int64(length), nil
+}
+
+// Rebuilds the index from the file, truncating it after the last good record.
+func (s *BlockStore) recover() error {
+	info, err := (*s).file.Stat()
+	if err != nil {
+		return err
+	}
+	var offset int64 = 0
+	for offset < info.Size() {
+		block, length, err := s.readRecord(offset)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, ErrBadEncoding) {
+				return err
+			}
+			fmt.Printf("Block store: dropping %d bytes after offset %d: %v\n", info.Size()-offset, offset, err)
+			if err := (*s).file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := (*s).file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		s.index(block.GetHashStr(), (*block).ChainLength, offset)
+		offset += length
+	}
+	(*s).size = offset
+	return nil
+}
+
+func (s *BlockStore) index(hash string, height uint32, offset int64) {
+	(*s).byHash[hash] = offset
+	(*s).byHeight[height] = append((*s).byHeight[height], hash)
+	(*s).order = append((*s).order, hash)
+}
+
+// Appends a block, unless it is already stored.
+func (s *BlockStore) Append(block *Block) error {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	hash := block.GetHashStr()
+	if _, ok := (*s).byHash[hash]; ok {
+		return nil
+	}
+	data, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	record := make([]byte, BLOCK_STORE_RECORD_HEADER, BLOCK_STORE_RECORD_HEADER+len(data))
+	binary.BigEndian.PutUint32(record[0:4], BLOCK_STORE_MAGIC)
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[8:12], crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+	if _, err := (*s).file.WriteAt(record, (*s).size); err != nil {
+		return err
+	}
+	s.index(hash, (*block).ChainLength, (*s).size)
+	(*s).size += int64(len(record))
+
+	(*s).unsynced++
+	if (*s).policy == SYNC_EVERY_BLOCK || ((*s).policy == SYNC_BATCHED && (*s).unsynced >= BLOCK_STORE_SYNC_BATCH) {
+		return s.sync()
+	}
+	return nil
+}
+
+func (s *BlockStore) sync() error {
+	(*s).unsynced = 0
+	return (*s).file.Sync()
+}
+
+func (s *BlockStore) Dir() string {
+	return (*s).dir
+}
+
+func (s *BlockStore) Has(hash string) bool {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	_, ok := (*s).byHash[hash]
+	return ok
+}
+
+func (s *BlockStore) Count() int {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	return len((*s).order)
+}
+
+// Reads a block back. Its derived fields (chain work and the retargeting
+// window) are only set once it is validated against its parent again.
+func (s *BlockStore) Get(hash string) (*Block, error) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	offset, ok := (*s).byHash[hash]
+	if !ok {
+		return nil, ErrBlockNotStored
+	}
+	block, _, err := s.readRecord(offset)
+	return block, err
+}
+
+// The hashes of the stored blocks at a height, in the order they were stored.
+func (s *BlockStore) HashesAt(height uint32) []string {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	return append([]string{}, (*s).byHeight[height]...)
+}
+
+// Calls fn with every stored block in the order they were appended, stopping
+// at the first error.
+func (s *BlockStore) ForEach(fn func(block *Block) error) error {
+	(*s).mu.Lock()
+	order := append([]string{}, (*s).order...)
+	(*s).mu.Unlock()
+	for _, hash := range order {
+		block, err := s.Get(hash)
+		if err != nil {
+			return err
+		}
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BlockStore) Sync() error {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	return s.sync()
+}
+
+func (s *BlockStore) Close() error {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	if err := s.sync(); err != nil {
+		(*s).file.Close()
+		return err
+	}
+	return (*s).file.Close()
+}
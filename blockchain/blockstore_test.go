@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{"alice": 100})
+	store, err := OpenBlockStore(dir, SYNC_EVERY_BLOCK)
+	if err != nil {
+		t.Fatalf("OpenBlockStore() Error: %v", err)
+	}
+	blocks := []*Block{genesis}
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, NewBlock("miner", blocks[i], CalculateTarget(12), config.coinbaseAmount))
+	}
+	for _, block := range blocks {
+		if err := store.Append(block); err != nil {
+			t.Fatalf("Append() Error: %v", err)
+		}
+	}
+	store.Append(blocks[1])
+	store.Close()
+
+	// The index is rebuilt from the file.
+	store, err = OpenBlockStore(dir, SYNC_EVERY_BLOCK)
+	if err != nil {
+		t.Fatalf("OpenBlockStore() Error: %v", err)
+	}
+	if store.Count() != len(blocks) {
+		t.Fatalf("Reopened store holds %d blocks, expected %d", store.Count(), len(blocks))
+	}
+	hashes := store.HashesAt(2)
+	if len(hashes) != 1 || hashes[0] != blocks[2].GetHashStr() {
+		t.Fatalf("HashesAt(2) returned %v", hashes)
+	}
+	stored, err := store.Get(blocks[3].GetHashStr())
+	if err != nil || stored.GetHashStr() != blocks[3].GetHashStr() {
+		t.Fatalf("Get() returned a different block: %v", err)
+	}
+	stored, err = store.Get(genesis.GetHashStr())
+	if err != nil || stored.BalanceOf("alice") != 100 {
+		t.Fatalf("Get() lost the starting balances: %v", err)
+	}
+	store.Close()
+
+	// A torn write at the end is cut off, and appending carries on after the
+	// last good record.
+	path := filepath.Join(dir, BLOCK_STORE_FILE)
+	info, _ := os.Stat(path)
+	goodSize := info.Size()
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0x53, 0x47, 0x42, 0x31, 0, 0, 1, 0, 7})
+	file.Close()
+	store, err = OpenBlockStore(dir, SYNC_BATCHED)
+	if err != nil {
+		t.Fatalf("OpenBlockStore() Error: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != goodSize || store.Count() != len(blocks) {
+		t.Fatalf("Torn record was not removed")
+	}
+	next := NewBlock("miner", blocks[3], CalculateTarget(12), config.coinbaseAmount)
+	store.Append(next)
+	store.Close()
+
+	// So is a record whose checksum does not match.
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 1
+	os.WriteFile(path, data, 0644)
+	store, err = OpenBlockStore(dir, SYNC_NEVER)
+	if err != nil {
+		t.Fatalf("OpenBlockStore() Error: %v", err)
+	}
+	defer store.Close()
+	if store.Count() != len(blocks) || store.Has(next.GetHashStr()) {
+		t.Fatalf("Corrupt record was not removed")
+	}
+}
+
+func TestBlockStoreUnknownEncoding(t *testing.T) {
+	dir := t.TempDir()
+	genesis, _, _ := MakeGenesisDefault(map[string]Amount{"alice": 100})
+	store, _ := OpenBlockStore(dir, SYNC_EVERY_BLOCK)
+	store.Append(genesis)
+	store.Close()
+
+	// An intact record in an encoding this node does not know is refused,
+	// and the file is left alone rather than truncated.
+	path := filepath.Join(dir, BLOCK_STORE_FILE)
+	data, _ := os.ReadFile(path)
+	body := data[BLOCK_STORE_RECORD_HEADER:]
+	body[0] = 9
+	binary.BigEndian.PutUint32(data[8:12], crc32.ChecksumIEEE(body))
+	os.WriteFile(path, data, 0644)
+	if _, err := OpenBlockStore(dir, SYNC_EVERY_BLOCK); !errors.Is(err, ErrStoreEncoding) {
+		t.Fatalf("OpenBlockStore() returned %v, expected ErrStoreEncoding", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("Store file was truncated to %d bytes", info.Size())
+	}
+}
+
+func TestTcpMinerReload(t *testing.T) {
+	dir := t.TempDir()
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	privKey, _, _ := GenerateKeypair()
+	store, _ := OpenBlockStore(dir, SYNC_EVERY_BLOCK)
+	node := NewTcpMiner("Pooly", NewRealNet(), NUM_ROUNDS_MINING, genesis, privKey, "", config)
+	if err := node.LoadBlockStore(store); err != nil {
+		t.Fatalf("LoadBlockStore() Error: %v", err)
+	}
+	node.StartNewSearch(nil)
+	mineTemplates(t, node, CONFIRMED_DEPTH+2)
+	store.Close()
+
+	// A restarted node picks up the same chain from disk.
+	store, _ = OpenBlockStore(dir, SYNC_EVERY_BLOCK)
+	defer store.Close()
+	restarted := NewTcpMiner("Pooly", NewRealNet(), NUM_ROUNDS_MINING, genesis, privKey, "", config)
+	if err := restarted.LoadBlockStore(store); err != nil {
+		t.Fatalf("LoadBlockStore() Error: %v", err)
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if restarted.LastBlock.GetHashStr() != node.LastBlock.GetHashStr() || len(restarted.Blocks) != len(node.Blocks) {
+		t.Fatalf("Reloaded head is at height %d, expected %d", restarted.LastBlock.ChainLength, node.LastBlock.ChainLength)
+	}
+	if restarted.LastConfirmedBlock.GetHashStr() != node.LastConfirmedBlock.GetHashStr() {
+		t.Fatalf("Reloaded confirmed block is at height %d, expected %d", restarted.LastConfirmedBlock.ChainLength, node.LastConfirmedBlock.ChainLength)
+	}
+	if restarted.LastBlock.BalanceOf(restarted.Address) != node.LastBlock.BalanceOf(node.Address) {
+		t.Fatalf("Reloaded balance differs")
+	}
+}
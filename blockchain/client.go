@@ -3,12 +3,15 @@ package main
 import (
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/chuckpreslar/emission"
 )
 
+var ErrNotPending = errors.New("no pending outgoing transaction with this id")
+
 // instead of using a constructor, we use a struct here to represent a client
 type Client struct {
 	Name                        string
@@ -18,14 +21,16 @@ type Client struct {
 	Blocks                      map[string]*Block
 	PendingOutgoingTransactions map[string]*Transaction
 	PendingReceivedTransactions map[string]*Transaction
-	PendingBlocks               map[string]*Set[*Block]
+	Orphans                     *OrphanPool
 	LastBlock                   *Block
 	LastConfirmedBlock          *Block
+	State                       *StateStore
 	ReceivedBlock               *Block
 	Config                      BlockchainConfig
 	Nonce                       uint32
 	Net                         *FakeNet
 	Emitter                     *emission.Emitter
+	reorgs                      *reorgQueue
 	mu                          sync.Mutex
 }
 
@@ -40,8 +45,13 @@ func (c *Client) SetGenesisBlock(startingBlock *Block) {
 	if (*c).LastBlock != nil {
 		fmt.Printf("Cannot set starting block for existing blockchain.")
 	}
+	if err := startingBlock.ValidateGenesis((*c).Config); err != nil {
+		fmt.Printf("Cannot set starting block: %v\n", err)
+		return
+	}
 	(*c).LastConfirmedBlock = startingBlock
 	(*c).LastBlock = startingBlock
+	(*c).State = NewStateStore(startingBlock)
 	blockId, err := startingBlock.GetHash()
 	if err != nil {
 		panic("Failed to get block hash")
@@ -50,35 +60,43 @@ func (c *Client) SetGenesisBlock(startingBlock *Block) {
 }
 
 // The amount of gold available to the client looking at the last confirmed block
-func (c *Client) ConfirmedBalance() uint32 {
+func (c *Client) ConfirmedBalance() Amount {
 	return (*c).LastConfirmedBlock.BalanceOf((*c).Address)
 }
 
-// Any gold received in the last confirmed block or before
-func (c *Client) AvailableGold() uint32 {
-	var pendingSpent uint32 = 0
-	for _, tx := range (*c).PendingOutgoingTransactions {
-		pendingSpent += tx.TotalOutput()
+// Any gold received in the last confirmed block or before, less what the
+// pending outgoing transactions will spend. Fails rather than wrapping
+// around if those transactions spend more than the confirmed balance.
+func (c *Client) AvailableGold() (Amount, error) {
+	pendingSpent, err := TotalSpent((*c).PendingOutgoingTransactions)
+	if err != nil {
+		return 0, err
 	}
-	return c.ConfirmedBalance() - pendingSpent
+	return c.ConfirmedBalance().CheckedSub(pendingSpent)
 }
 
 // Broadcasts a transaction from the client giving gold to the clients
-func (c *Client) PostTransaction(outputs []Output, fee uint32) *Transaction {
+func (c *Client) PostTransaction(outputs []Output, fee Amount) (*Transaction, error) {
 
 	(*c).mu.Lock()
 	defer (*c).mu.Unlock()
 
-	total := fee
-	for _, output := range outputs {
-		total += output.Amount
+	total, err := OutputsTotal(outputs, fee)
+	if err != nil {
+		return nil, err
 	}
-	if total > c.AvailableGold() {
-		// modify here
-		panic(`Account doesn't have enough balance for transaction`)
+	available, err := c.AvailableGold()
+	if err != nil {
+		return nil, err
+	}
+	if total > available {
+		return nil, fmt.Errorf("%w: spends %d of %d available", ErrInsufficientFunds, total, available)
 	}
 	// add data to the constructor
-	tx, _ := NewTransaction((*c).Address, (*c).Nonce, (*c).PubKey, nil, fee, outputs, nil)
+	tx, err := NewTransaction((*c).Address, (*c).Nonce, (*c).PubKey, nil, fee, outputs, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	tx.Sign((*c).PrivKey)
 	(*c).PendingOutgoingTransactions[tx.Id()] = tx
@@ -86,7 +104,41 @@ func (c *Client) PostTransaction(outputs []Output, fee uint32) *Transaction {
 	data, _ := TransactionToBytes(tx)
 	(*c).Net.Broadcast(POST_TRANSACTION, data)
 
-	return tx
+	return tx, nil
+}
+
+// Replaces a pending transaction with one paying newFee, keeping its nonce
+// and outputs, so that a transaction stuck behind higher fees gets mined.
+// The superseded transaction is dropped from the pending list.
+func (c *Client) BumpFee(txId string, newFee Amount) (*Transaction, error) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+
+	old, ok := (*c).PendingOutgoingTransactions[txId]
+	if !ok {
+		return nil, ErrNotPending
+	}
+	if minFee, err := (*old).Info.Fee.CheckedAdd(MIN_FEE_BUMP); err != nil || newFee < minFee {
+		return nil, fmt.Errorf("%w: fee %d, replacing fee %d", ErrReplacementUnderpriced, newFee, (*old).Info.Fee)
+	}
+	available, err := c.AvailableGold()
+	if err != nil {
+		return nil, err
+	}
+	if extra := newFee - (*old).Info.Fee; extra > available {
+		return nil, fmt.Errorf("%w: raising the fee by %d with %d available", ErrInsufficientFunds, extra, available)
+	}
+	tx, err := NewTransaction((*c).Address, (*old).Info.Nonce, (*c).PubKey, nil, newFee, (*old).Info.Outputs, (*old).Info.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.Sign((*c).PrivKey)
+	delete((*c).PendingOutgoingTransactions, txId)
+	(*c).PendingOutgoingTransactions[tx.Id()] = tx
+	data, _ := TransactionToBytes(tx)
+	(*c).Net.Broadcast(POST_TRANSACTION, data)
+	return tx, nil
 }
 
 // Validates and adds a block to the list of blocks, possibly
@@ -102,6 +154,13 @@ func (c *Client) ReceiveBlock(b Block) *Block {
 		return nil
 	}
 
+	if block.IsGenesisBlock() {
+		if err := block.ValidateGenesis((*c).Config); err != nil {
+			c.Log(fmt.Sprintf("Rejected block %v: %v\n", blockId, err))
+			return nil
+		}
+	}
+
 	if !block.hasValidProof() && !block.IsGenesisBlock() {
 		c.Log(fmt.Sprintf("Block %v does not have a valid proof\n", blockId))
 		return nil
@@ -111,20 +170,23 @@ func (c *Client) ReceiveBlock(b Block) *Block {
 	prevBlock, received := (*c).Blocks[(*block).PrevBlockHash]
 	if !received && !block.IsGenesisBlock() {
 
-		stuckBlocks, received := (*c).PendingBlocks[(*block).PrevBlockHash]
-		if !received {
+		// FakeNet does not say who sent a block, so all orphans share one
+		// quota.
+		newParent, err := (*c).Orphans.Add(block, "", (*c).LastBlock)
+		if err != nil {
+			c.Log(fmt.Sprintf("Rejected orphan block %v: %v\n", blockId, err))
+			return nil
+		}
+		if newParent {
 			c.RequestMissingBlock(block)
-			// TODO: Define a set
-			stuckBlocks = NewSet[*Block]()
 		}
-		stuckBlocks.Add(block)
-		(*c).PendingBlocks[(*block).PrevBlockHash] = stuckBlocks
 		return nil
 
 	}
 
 	if !block.IsGenesisBlock() {
-		if !block.Rerun(prevBlock) {
+		if err := block.ValidateBlock(prevBlock, (*c).Config); err != nil {
+			c.Log(fmt.Sprintf("Rejected block %v: %v\n", blockId, err))
 			return nil
 		}
 	}
@@ -132,20 +194,17 @@ func (c *Client) ReceiveBlock(b Block) *Block {
 	blockId, _ = block.GetHash()
 	(*c).Blocks[blockId] = block
 
-	if (*(*c).LastBlock).ChainLength < (*block).ChainLength {
-		(*c).LastBlock = block
-		c.SetLastConfirmed()
-	}
-
-	unstuckBlocks, received := (*c).PendingBlocks[blockId]
-	var unstuckBlocksArr []*Block
-	if received {
-		unstuckBlocksArr = unstuckBlocks.ToArray()
+	if block.HasMoreWorkThan((*c).LastBlock) {
+		if reorg, err := reorganize((*c).State, block); err != nil {
+			fmt.Println("ReceiveBlock() failed to switch to the new head:", err)
+		} else {
+			(*c).LastBlock = block
+			c.SetLastConfirmed()
+			(*c).reorgs.push(reorg)
+		}
 	}
 
-	delete((*c).PendingBlocks, blockId)
-
-	for _, uBlock := range unstuckBlocksArr {
+	for _, uBlock := range (*c).Orphans.TakeChildren(blockId) {
 		c.Log(fmt.Sprintf("processing unstuck block %v", uBlock.GetHashStr()))
 		// Need to change the "" into empty []byte
 		go c.ReceiveBlock(*uBlock)
@@ -223,7 +282,9 @@ func (c *Client) SetLastConfirmed() {
 	}
 	(*c).LastConfirmedBlock = block
 	for id, tx := range (*c).PendingOutgoingTransactions {
-		if (*c).LastConfirmedBlock.Contains(tx) {
+		// A transaction whose nonce is used up was either confirmed or
+		// superseded by a replacement that was.
+		if (*c).LastConfirmedBlock.Contains(tx) || (*tx).Info.Nonce < (*c).LastConfirmedBlock.NonceOf((*c).Address) {
 			delete((*c).PendingOutgoingTransactions, id)
 		}
 	}
@@ -233,9 +294,9 @@ func (c *Client) SetLastConfirmed() {
 func (c *Client) ShowAllBalances() {
 
 	fmt.Printf("Showing balances:")
-	for id, balance := range (*(*c).LastConfirmedBlock).Balances {
-		fmt.Printf("	%v", id)
-		fmt.Printf("	%v", balance)
+	for _, account := range (*c).LastConfirmedBlock.Accounts() {
+		fmt.Printf("	%v", account.Address)
+		fmt.Printf("	%v", account.Balance)
 		fmt.Println("")
 	}
 }
@@ -262,10 +323,11 @@ func (c *Client) ShowBlockchain() {
 	}
 }
 
-func NewClient(name string, Net *FakeNet, startingBlock *Block, keyPair *rsa.PrivateKey) *Client {
+func NewClient(name string, Net *FakeNet, startingBlock *Block, keyPair *rsa.PrivateKey, config BlockchainConfig) *Client {
 	var c Client
 	c.Net = Net
 	c.Name = name
+	c.Config = config
 
 	if keyPair == nil {
 		c.PrivKey, c.PubKey, _ = GenerateKeypair()
@@ -279,13 +341,14 @@ func NewClient(name string, Net *FakeNet, startingBlock *Block, keyPair *rsa.Pri
 	c.PendingOutgoingTransactions = make(map[string]*Transaction)
 	c.PendingReceivedTransactions = make(map[string]*Transaction)
 	c.Blocks = make(map[string]*Block)
-	c.PendingBlocks = make(map[string]*Set[*Block])
+	c.Orphans = NewOrphanPool(ORPHAN_MAX_COUNT, ORPHAN_MAX_BYTES, ORPHAN_MAX_PER_PEER, ORPHAN_EXPIRY)
 
 	if startingBlock != nil {
 		c.SetGenesisBlock(startingBlock)
 	}
 
 	c.Emitter = emission.NewEmitter()
+	c.reorgs = newReorgQueue(c.Emitter)
 	c.Emitter.On(PROOF_FOUND, c.ReceiveBlockBytes)
 	c.Emitter.On(MISSING_BLOCK, c.ProvideMissingBlock)
 	return &c
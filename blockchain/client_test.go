@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -19,12 +20,12 @@ func TestNewClient(t *testing.T) {
 	address1 := GenerateAddress(pubKey1)
 	address2 := GenerateAddress(pubKey2)
 	address3 := GenerateAddress(pubKey3)
-	newBalances := map[string]uint32{address1: 1000, address2: 500}
+	newBalances := map[string]Amount{address1: 1000, address2: 500}
 	genesis, config, _ := MakeGenesisDefault(newBalances)
 
-	client1 := NewClient("Alice", net, genesis, privKey1)
-	client2 := NewClient("Bob", net, genesis, privKey2)
-	client3 := NewClient("Cindy", net, genesis, privKey3)
+	client1 := NewClient("Alice", net, genesis, privKey1, config)
+	client2 := NewClient("Bob", net, genesis, privKey2, config)
+	client3 := NewClient("Cindy", net, genesis, privKey3, config)
 
 	net.Register(client1, client2, client3)
 
@@ -110,3 +111,121 @@ func TestNewClient(t *testing.T) {
 	client3.ShowBlockchain()
 
 }
+
+func TestReceiveBlockWithWrongTarget(t *testing.T) {
+	net := NewFakeNet()
+	privKey1, pubKey1, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	genesis, config, _ := MakeGenesis(8, COINBASE_AMT_ALLOWED, DEFAULT_TX_FEE, CONFIRMED_DEPTH, map[string]Amount{address1: 100})
+
+	client1 := NewClient("Alice", net, genesis, privKey1, config)
+	net.Register(client1)
+
+	// A block mined against an easier target than the chain requires.
+	easyBlock := NewBlock(address1, genesis, CalculateTarget(4), config.coinbaseAmount)
+	for !easyBlock.hasValidProof() {
+		easyBlock.Proof++
+	}
+	if client1.ReceiveBlock(*easyBlock) != nil {
+		t.Fatalf("Accepted a block with the wrong target")
+	}
+
+	goodBlock := NewBlock(address1, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	for !goodBlock.hasValidProof() {
+		goodBlock.Proof++
+	}
+	if client1.ReceiveBlock(*goodBlock) == nil {
+		t.Fatalf("Rejected a block with the expected target")
+	}
+}
+
+func TestForkChoiceFirstSeen(t *testing.T) {
+	net := NewFakeNet()
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	genesis, config, _ := MakeGenesis(8, COINBASE_AMT_ALLOWED, DEFAULT_TX_FEE, CONFIRMED_DEPTH, map[string]Amount{address1: 100})
+
+	client1 := NewClient("Alice", net, genesis, privKey1, config)
+	net.Register(client1)
+
+	// Two competing blocks at the same height with the same target.
+	target := config.NextTarget(genesis)
+	first := NewBlock(address1, genesis, target, config.coinbaseAmount)
+	second := NewBlock(address2, genesis, target, config.coinbaseAmount)
+	for !first.hasValidProof() {
+		first.Proof++
+	}
+	for !second.hasValidProof() {
+		second.Proof++
+	}
+
+	client1.ReceiveBlock(*first)
+	client1.ReceiveBlock(*second)
+	if client1.LastBlock.GetHashStr() != first.GetHashStr() {
+		t.Fatalf("Head switched to a block with equal work")
+	}
+
+	// Extending the second block gives it more work, so it takes over.
+	third := NewBlock(address2, second, config.NextTarget(second), config.coinbaseAmount)
+	for !third.hasValidProof() {
+		third.Proof++
+	}
+	client1.ReceiveBlock(*third)
+	if client1.LastBlock.GetHashStr() != third.GetHashStr() {
+		t.Fatalf("Head did not switch to the chain with more work")
+	}
+}
+
+func TestRejectForgedGenesis(t *testing.T) {
+	net := NewFakeNet()
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 100})
+
+	client1 := NewClient("Alice", net, genesis, privKey1, config)
+	net.Register(client1)
+
+	// A zero-height block that hands the attacker a fortune.
+	forged, _, _ := MakeGenesisDefault(map[string]Amount{address1: 100, address2: 1000000})
+	if client1.ReceiveBlock(*forged) != nil {
+		t.Fatalf("Accepted a forged genesis block")
+	}
+	if _, stored := client1.Blocks[forged.GetHashStr()]; stored {
+		t.Fatalf("Stored a forged genesis block")
+	}
+
+	// Blocks built on the forged genesis never find a parent.
+	child := NewBlock(address2, forged, config.NextTarget(forged), config.coinbaseAmount)
+	for !child.hasValidProof() {
+		child.Proof++
+	}
+	if client1.ReceiveBlock(*child) != nil {
+		t.Fatalf("Accepted a block that does not descend from the pinned genesis")
+	}
+}
+
+func TestClientBumpFee(t *testing.T) {
+	privKey, pubKey, _ := GenerateKeypair()
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{GenerateAddress(pubKey): 10})
+	client := NewClient("Alice", NewFakeNet(), genesis, privKey, config)
+
+	tx, err := client.PostTransaction([]Output{{Address: "someone", Amount: 8}}, 1)
+	if err != nil {
+		t.Fatalf("PostTransaction() Error: %v", err)
+	}
+	// Only 1 gold is left to raise the fee with.
+	if _, err := client.BumpFee(tx.Id(), 3); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("BumpFee() past the available gold returned %v", err)
+	}
+	bumped, err := client.BumpFee(tx.Id(), 2)
+	if err != nil {
+		t.Fatalf("BumpFee() Error: %v", err)
+	}
+	if len(client.PendingOutgoingTransactions) != 1 || client.PendingOutgoingTransactions[bumped.Id()] != bumped || client.Nonce != 1 {
+		t.Fatalf("Wallet should hold only the replacement")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Canonical binary encoding of blocks and transactions. Hashes and signatures
+// are taken over this encoding rather than over JSON, so that they do not
+// depend on how encoding/json lays out big.Int, rsa.PublicKey or time.Time.
+//
+// Every top-level encoding starts with a version byte. After that, integers
+// and amounts are big-endian and fixed width, strings and byte slices are
+// prefixed with their length as a uint32, and lists with their count as a
+// uint32. Block headers have their own fixed-size layout, see BlockHeader.
+//
+// Transactions and blocks are versioned separately, so that a change to the
+// block layout leaves transaction ids and signatures alone. Decoders refuse
+// versions they do not know. Block versions:
+//  1. Blocks hashed over their whole encoding.
+//  2. Blocks hashed over the fixed-size BlockHeader.
+//  3. An ExtraNonce in the BlockHeader, before the proof.
+//  4. The block body lists only the accounts the block changes, and the
+//     encoding leads with its own version byte ahead of the header. Version 3
+//     blocks, which start with the header and list every account, are still
+//     read, since their body decodes as a diff.
+//
+// BLOCK_HEADER_VERSION is the version byte inside the header. It only moves
+// when the header layout does, so block hashes survive body changes.
+const TX_ENCODING_VERSION byte = 1
+const BLOCK_ENCODING_VERSION byte = 4
+const BLOCK_HEADER_VERSION byte = 3
+
+var ErrBadEncoding = errors.New("bad binary encoding")
+
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) putUint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	(*e).data = append((*e).data, buf[:]...)
+}
+
+func (e *encoder) putUint64(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	(*e).data = append((*e).data, buf[:]...)
+}
+
+func (e *encoder) putBytes(v []byte) {
+	e.putUint32(uint32(len(v)))
+	(*e).data = append((*e).data, v...)
+}
+
+func (e *encoder) putString(v string) {
+	e.putBytes([]byte(v))
+}
+
+// Reads the encoding back. The first failure is kept in err and every later
+// read returns a zero value, so callers only need to check err at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if (*d).err != nil {
+		return nil
+	}
+	if n < 0 || n > len((*d).data) {
+		(*d).err = fmt.Errorf("%w: unexpected end of data", ErrBadEncoding)
+		return nil
+	}
+	v := (*d).data[:n]
+	(*d).data = (*d).data[n:]
+	return v
+}
+
+func (d *decoder) getUint32() uint32 {
+	v := d.next(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (d *decoder) getUint64() uint64 {
+	v := d.next(8)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (d *decoder) getBytes() []byte {
+	n := d.getUint32()
+	v := d.next(int(n))
+	if v == nil {
+		return nil
+	}
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out
+}
+
+func (d *decoder) getString() string {
+	return string(d.getBytes())
+}
+
+// A list count, refusing counts that could not possibly fit in the remaining
+// data so that a corrupt count cannot make us allocate a huge slice.
+func (d *decoder) getCount(minItemSize int) int {
+	n := d.getUint32()
+	if (*d).err == nil && uint64(n)*uint64(minItemSize) > uint64(len((*d).data)) {
+		(*d).err = fmt.Errorf("%w: count %d exceeds data", ErrBadEncoding, n)
+	}
+	if (*d).err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) getVersion(expected byte) {
+	version := d.next(1)
+	if version != nil && version[0] != expected {
+		(*d).err = fmt.Errorf("%w: unknown version %d", ErrBadEncoding, version[0])
+	}
+}
+
+func (d *decoder) finish() error {
+	if (*d).err == nil && len((*d).data) > 0 {
+		(*d).err = fmt.Errorf("%w: %d trailing bytes", ErrBadEncoding, len((*d).data))
+	}
+	return (*d).err
+}
+
+// TransactionInfo: From, Nonce, Pubkey (N as bytes, E as uint64), Fee, then
+// each output's Address and Amount, then Data.
+func (txInfo *TransactionInfo) encodeTo(e *encoder) error {
+	if (*txInfo).Pubkey.E < 0 {
+		return fmt.Errorf("negative public exponent %d", (*txInfo).Pubkey.E)
+	}
+	e.putString((*txInfo).From)
+	e.putUint32((*txInfo).Nonce)
+	var n []byte
+	if (*txInfo).Pubkey.N != nil {
+		n = (*txInfo).Pubkey.N.Bytes()
+	}
+	e.putBytes(n)
+	e.putUint64(uint64((*txInfo).Pubkey.E))
+	e.putUint64(uint64((*txInfo).Fee))
+	e.putUint32(uint32(len((*txInfo).Outputs)))
+	for _, output := range (*txInfo).Outputs {
+		e.putString(output.Address)
+		e.putUint64(uint64(output.Amount))
+	}
+	e.putBytes((*txInfo).Data)
+	return nil
+}
+
+func (txInfo *TransactionInfo) decodeFrom(d *decoder) {
+	(*txInfo).From = d.getString()
+	(*txInfo).Nonce = d.getUint32()
+	(*txInfo).Pubkey.N = new(big.Int).SetBytes(d.getBytes())
+	(*txInfo).Pubkey.E = int(d.getUint64())
+	(*txInfo).Fee = Amount(d.getUint64())
+	count := d.getCount(12)
+	(*txInfo).Outputs = make([]Output, count)
+	for i := range (*txInfo).Outputs {
+		(*txInfo).Outputs[i].Address = d.getString()
+		(*txInfo).Outputs[i].Amount = Amount(d.getUint64())
+	}
+	(*txInfo).Data = d.getBytes()
+}
+
+func (txInfo *TransactionInfo) MarshalBinary() ([]byte, error) {
+	e := encoder{data: []byte{TX_ENCODING_VERSION}}
+	if err := txInfo.encodeTo(&e); err != nil {
+		return nil, err
+	}
+	return e.data, nil
+}
+
+func (txInfo *TransactionInfo) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data}
+	d.getVersion(TX_ENCODING_VERSION)
+	txInfo.decodeFrom(&d)
+	return d.finish()
+}
+
+// Transaction: the TransactionInfo fields followed by Sig.
+func (tx *Transaction) encodeTo(e *encoder) error {
+	if err := (&(*tx).Info).encodeTo(e); err != nil {
+		return err
+	}
+	e.putBytes((*tx).Sig)
+	return nil
+}
+
+func (tx *Transaction) decodeFrom(d *decoder) {
+	(&(*tx).Info).decodeFrom(d)
+	(*tx).Sig = d.getBytes()
+}
+
+func (tx *Transaction) MarshalBinary() ([]byte, error) {
+	e := encoder{data: []byte{TX_ENCODING_VERSION}}
+	if err := tx.encodeTo(&e); err != nil {
+		return nil, err
+	}
+	return e.data, nil
+}
+
+func (tx *Transaction) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data}
+	d.getVersion(TX_ENCODING_VERSION)
+	tx.decodeFrom(&d)
+	return d.finish()
+}
+
+// Block: the version byte and the fixed-size header, then RewardAddr and CoinbaseReward, which
+// the header only commits to by hash, then the balances and non-zero nonces
+// of the accounts in Diff, and the Transactions. The undo data, WindowStart
+// and ChainWork are derived by the receiver when it replays the block, and
+// transaction ids are recomputed rather than trusted.
+func (block *Block) MarshalBinary() ([]byte, error) {
+	data, err := block.hashData()
+	if err != nil {
+		return nil, err
+	}
+	e := encoder{data: append([]byte{BLOCK_ENCODING_VERSION}, data...)}
+	e.putString((*block).RewardAddr)
+	e.putUint64(uint64((*block).CoinbaseReward))
+	changes := (*block).Diff.Changes
+	e.putUint32(uint32(len(changes)))
+	for _, v := range changes {
+		e.putString(v.After.Address)
+		e.putUint64(uint64(v.After.Balance))
+	}
+	nonces := 0
+	for _, v := range changes {
+		if v.After.Nonce != 0 {
+			nonces++
+		}
+	}
+	e.putUint32(uint32(nonces))
+	for _, v := range changes {
+		if v.After.Nonce != 0 {
+			e.putString(v.After.Address)
+			e.putUint32(v.After.Nonce)
+		}
+	}
+	e.putUint32(uint32(len((*block).Transactions)))
+	for i := range (*block).Transactions {
+		if err := (&(*block).Transactions[i].Tx).encodeTo(&e); err != nil {
+			return nil, err
+		}
+	}
+	return e.data, nil
+}
+
+func (block *Block) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data}
+	if len(data) > 0 && data[0] != BLOCK_HEADER_VERSION {
+		d.getVersion(BLOCK_ENCODING_VERSION)
+	}
+	var header BlockHeader
+	if headerData := d.next(BLOCK_HEADER_SIZE); headerData != nil {
+		if err := header.UnmarshalBinary(headerData); err != nil {
+			return err
+		}
+	}
+	rewardAddr := d.getString()
+	coinbaseReward := Amount(d.getUint64())
+
+	var diff StateDiff
+	balances := d.getCount(12)
+	for i := 0; i < balances; i++ {
+		account := AccountState{Address: d.getString(), Balance: Amount(d.getUint64())}
+		diff.set(account, AccountState{}, false)
+	}
+	nonces := d.getCount(8)
+	for i := 0; i < nonces; i++ {
+		address := d.getString()
+		account := AccountState{Address: address}
+		if change, ok := diff.lookup(address); ok {
+			account = (*change).After
+		}
+		account.Nonce = d.getUint32()
+		diff.set(account, AccountState{}, false)
+	}
+	transactions := make([]TransactionType, d.getCount(40))
+	for i := range transactions {
+		transactions[i].Tx.decodeFrom(&d)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if coinbaseHash(rewardAddr, coinbaseReward) != header.CoinbaseHash {
+		return fmt.Errorf("%w: coinbase does not match the header", ErrBadEncoding)
+	}
+
+	*block = Block{
+		Diff:           diff,
+		Transactions:   transactions,
+		RewardAddr:     rewardAddr,
+		CoinbaseReward: coinbaseReward,
+	}
+	header.applyTo(block)
+	for i := range (*block).Transactions {
+		(*block).Transactions[i].Id = (*block).Transactions[i].Tx.Id()
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Size in bytes of an encoded BlockHeader. The proof is the last field, so a
+// miner can serialize the header once and only rewrite the final four bytes.
+const BLOCK_HEADER_SIZE = 1 + 5*32 + 4 + 8 + 8 + 4
+const proofOffset = BLOCK_HEADER_SIZE - 4
+
+// The fixed-size part of a block that its hash commits to. Transactions are
+// committed through TxRoot, the resulting balances and nonces through
+// StateRoot, and the reward address and coinbase reward through CoinbaseHash,
+// so the hash never depends on the size of the block body.
+type BlockHeader struct {
+	Version       byte
+	PrevBlockHash [32]byte
+	TxRoot        [32]byte
+	StateRoot     [32]byte
+	CoinbaseHash  [32]byte
+	Target        [32]byte
+	ChainLength   uint32
+	Timestamp     int64
+	ExtraNonce    uint64
+	Proof         uint32
+}
+
+// Converts a hex hash from the block into its header form. The genesis block
+// has no previous hash, which is encoded as all zeros.
+func headerHash(hexHash string) ([32]byte, error) {
+	var hash [32]byte
+	if hexHash == "" {
+		return hash, nil
+	}
+	decoded, err := hex.DecodeString(hexHash)
+	if err != nil || len(decoded) != len(hash) {
+		return hash, fmt.Errorf("%q is not a 32-byte hex hash", hexHash)
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+func headerHashString(hash [32]byte) string {
+	if hash == [32]byte{} {
+		return ""
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+// Commits to who receives the block reward and how much coinbase it claims.
+func coinbaseHash(rewardAddr string, coinbaseReward Amount) [32]byte {
+	e := encoder{}
+	e.putString(rewardAddr)
+	e.putUint64(uint64(coinbaseReward))
+	return sha256.Sum256(e.data)
+}
+
+func (block *Block) Header() (*BlockHeader, error) {
+	var header BlockHeader
+	var err error
+	block.refreshRoots()
+	header.Version = BLOCK_HEADER_VERSION
+	if header.PrevBlockHash, err = headerHash((*block).PrevBlockHash); err != nil {
+		return nil, err
+	}
+	if header.TxRoot, err = headerHash((*block).TxRoot); err != nil {
+		return nil, err
+	}
+	if header.StateRoot, err = headerHash((*block).StateRoot); err != nil {
+		return nil, err
+	}
+	header.CoinbaseHash = coinbaseHash((*block).RewardAddr, (*block).CoinbaseReward)
+	target := &(*block).Target
+	if target.Sign() < 0 || target.BitLen() > 256 {
+		return nil, fmt.Errorf("target %x does not fit in 32 bytes", target)
+	}
+	target.FillBytes(header.Target[:])
+	header.ChainLength = (*block).ChainLength
+	header.Timestamp = (*block).Timestamp.UnixNano()
+	header.ExtraNonce = (*block).ExtraNonce
+	header.Proof = (*block).Proof
+	return &header, nil
+}
+
+func (header *BlockHeader) encode(data []byte) {
+	data[0] = (*header).Version
+	copy(data[1:33], (*header).PrevBlockHash[:])
+	copy(data[33:65], (*header).TxRoot[:])
+	copy(data[65:97], (*header).StateRoot[:])
+	copy(data[97:129], (*header).CoinbaseHash[:])
+	copy(data[129:161], (*header).Target[:])
+	binary.BigEndian.PutUint32(data[161:165], (*header).ChainLength)
+	binary.BigEndian.PutUint64(data[165:173], uint64((*header).Timestamp))
+	binary.BigEndian.PutUint64(data[173:181], (*header).ExtraNonce)
+	binary.BigEndian.PutUint32(data[proofOffset:], (*header).Proof)
+}
+
+func (header *BlockHeader) MarshalBinary() ([]byte, error) {
+	data := make([]byte, BLOCK_HEADER_SIZE)
+	header.encode(data)
+	return data, nil
+}
+
+func (header *BlockHeader) UnmarshalBinary(data []byte) error {
+	if len(data) != BLOCK_HEADER_SIZE {
+		return fmt.Errorf("%w: header is %d bytes, expected %d", ErrBadEncoding, len(data), BLOCK_HEADER_SIZE)
+	}
+	if data[0] != BLOCK_HEADER_VERSION {
+		return fmt.Errorf("%w: unknown version %d", ErrBadEncoding, data[0])
+	}
+	(*header).Version = data[0]
+	copy((*header).PrevBlockHash[:], data[1:33])
+	copy((*header).TxRoot[:], data[33:65])
+	copy((*header).StateRoot[:], data[65:97])
+	copy((*header).CoinbaseHash[:], data[97:129])
+	copy((*header).Target[:], data[129:161])
+	(*header).ChainLength = binary.BigEndian.Uint32(data[161:165])
+	(*header).Timestamp = int64(binary.BigEndian.Uint64(data[165:173]))
+	(*header).ExtraNonce = binary.BigEndian.Uint64(data[173:181])
+	(*header).Proof = binary.BigEndian.Uint32(data[proofOffset:])
+	return nil
+}
+
+func (header *BlockHeader) Hash() [32]byte {
+	var data [BLOCK_HEADER_SIZE]byte
+	header.encode(data[:])
+	return sha256.Sum256(data[:])
+}
+
+// Copies the header fields back into a block. The reward address and
+// coinbase reward only appear in the header as a hash, so they are left to
+// the caller.
+func (header *BlockHeader) applyTo(block *Block) {
+	(*block).PrevBlockHash = headerHashString((*header).PrevBlockHash)
+	(*block).TxRoot = hex.EncodeToString((*header).TxRoot[:])
+	(*block).StateRoot = hex.EncodeToString((*header).StateRoot[:])
+	(*block).Target.SetBytes((*header).Target[:])
+	(*block).ChainLength = (*header).ChainLength
+	(*block).Timestamp = time.Unix(0, (*header).Timestamp).UTC()
+	(*block).ExtraNonce = (*header).ExtraNonce
+	(*block).Proof = (*header).Proof
+}
+
+// Searches for a proof for a fixed block template. The header is serialized
+// once, and each attempt only rewrites the proof bytes before hashing.
+type ProofSearch struct {
+	data   [BLOCK_HEADER_SIZE]byte
+	target [32]byte
+}
+
+func (header *BlockHeader) NewProofSearch() *ProofSearch {
+	var search ProofSearch
+	header.encode(search.data[:])
+	search.target = (*header).Target
+	return &search
+}
+
+func (block *Block) NewProofSearch() (*ProofSearch, error) {
+	header, err := block.Header()
+	if err != nil {
+		return nil, err
+	}
+	return header.NewProofSearch(), nil
+}
+
+// Reports whether the given proof makes the header hash fall below the target.
+func (search *ProofSearch) Check(proof uint32) bool {
+	binary.BigEndian.PutUint32((*search).data[proofOffset:], proof)
+	hash := sha256.Sum256((*search).data[:])
+	return bytes.Compare(hash[:], (*search).target[:]) < 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestBlockHeader(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	block := NewBlock("miner", genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	block.Proof = 7
+
+	header, err := block.Header()
+	if err != nil {
+		t.Fatalf("Header() Error: %v", err)
+	}
+	data, _ := header.MarshalBinary()
+	if len(data) != BLOCK_HEADER_SIZE {
+		t.Fatalf("Header is %d bytes, expected %d", len(data), BLOCK_HEADER_SIZE)
+	}
+	var decoded BlockHeader
+	if err := decoded.UnmarshalBinary(data); err != nil || decoded != *header {
+		t.Fatalf("Decoded header does not match the original: %v", err)
+	}
+
+	// A proof search must agree with hasValidProof for every proof it tries.
+	search, _ := block.NewProofSearch()
+	for proof := uint32(0); proof < 1000; proof++ {
+		block.Proof = proof
+		if search.Check(proof) != block.hasValidProof() {
+			t.Fatalf("ProofSearch and hasValidProof disagree on proof %d", proof)
+		}
+	}
+}
+
+// A block with a realistic body, to show the cost of hashing it.
+func benchmarkBlock(b *testing.B) *Block {
+	privKey, pubKey, _ := GenerateKeypair()
+	address := GenerateAddress(pubKey)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address: 1000000})
+	block := NewBlock(address, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	for nonce := uint32(0); nonce < 100; nonce++ {
+		tx, _ := NewTransaction(address, nonce, pubKey, nil, 1, []Output{{Address: "bob", Amount: 10}}, nil)
+		tx.Sign(privKey)
+		if !block.AddTransaction(tx) {
+			b.Fatalf("Failed to add transaction %d", nonce)
+		}
+	}
+	return block
+}
+
+func reportHashrate(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "hashes/s")
+}
+
+// How proofs used to be checked: the whole block, transactions included, was
+// copied and JSON-marshalled for every proof.
+func BenchmarkProofLegacyJSON(b *testing.B) {
+	block := benchmarkBlock(b)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		(*block).Proof = uint32(i)
+		copied := *block
+		copied.Diff = StateDiff{}
+		data, _ := json.Marshal(&copied)
+		hash := sha256.Sum256(data)
+		new(big.Int).SetBytes(hash[:]).Cmp(&(*block).Target)
+	}
+	reportHashrate(b, start)
+}
+
+func BenchmarkProofHeader(b *testing.B) {
+	block := benchmarkBlock(b)
+	search, _ := block.NewProofSearch()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		search.Check(uint32(i))
+	}
+	reportHashrate(b, start)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// Limits on the transactions a miner keeps waiting for a block.
+const MEMPOOL_MAX_COUNT int = 5000
+const MEMPOOL_MAX_BYTES int = 4 << 20
+
+// How much more a transaction must pay in fees to replace a pending one with
+// the same nonce.
+const MIN_FEE_BUMP Amount = 1
+
+// Transactions a sender may have waiting on a gap in their nonces.
+const MEMPOOL_MAX_QUEUED_PER_SENDER int = 16
+
+// Limits on the transactions a miner puts into one block template.
+const BLOCK_MAX_TRANSACTIONS int = 500
+const BLOCK_MAX_BYTES int = 1 << 20
+
+var ErrKnownTransaction = errors.New("transaction is already in the mempool")
+var ErrNonceConflict = errors.New("another transaction with this nonce is in the mempool")
+var ErrMempoolFull = errors.New("mempool is full and the transaction's fee is too low")
+
+// Reasons a transaction is refused admission to the mempool.
+var (
+	ErrUnsignedTransaction    = errors.New("transaction is not signed")
+	ErrBadSignature           = errors.New("transaction signature is invalid")
+	ErrStaleNonce             = errors.New("transaction nonce has already been used")
+	ErrInsufficientFunds      = errors.New("sender cannot cover the transaction and their other pending transactions")
+	ErrSenderQueueFull        = errors.New("sender has too many transactions waiting on a nonce gap")
+	ErrReplacementUnderpriced = errors.New("replacement does not raise the fee enough")
+)
+
+type mempoolEntry struct {
+	tx   *Transaction
+	id   string
+	size int
+	// Position in the Mempool's tails heap, or -1 if the entry is not its
+	// sender's highest nonce.
+	tailIndex int
+}
+
+// Orders entries by fee, highest first, breaking ties by id so that every
+// miner picks the same transactions.
+func (e *mempoolEntry) betterThan(other *mempoolEntry) bool {
+	if (*e).tx.Info.Fee != (*other).tx.Info.Fee {
+		return (*e).tx.Info.Fee > (*other).tx.Info.Fee
+	}
+	return (*e).id < (*other).id
+}
+
+// Transactions waiting to be mined, indexed by id and by sender and nonce.
+// Each sender's highest nonce is also kept in a heap, so the next eviction is
+// found without going through every sender. It is not safe for concurrent
+// use; the miner's lock guards it.
+type Mempool struct {
+	entries  map[string]*mempoolEntry
+	senders  map[string]map[uint32]*mempoolEntry
+	tails    mempoolTails
+	tailOf   map[string]*mempoolEntry
+	bytes    int
+	maxCount int
+	maxBytes int
+}
+
+func NewMempool(maxCount int, maxBytes int) *Mempool {
+	var p Mempool
+	p.entries = make(map[string]*mempoolEntry)
+	p.senders = make(map[string]map[uint32]*mempoolEntry)
+	p.tailOf = make(map[string]*mempoolEntry)
+	p.maxCount = maxCount
+	p.maxBytes = maxBytes
+	return &p
+}
+
+func (p *Mempool) Size() int {
+	return len((*p).entries)
+}
+
+func (p *Mempool) Bytes() int {
+	return (*p).bytes
+}
+
+func (p *Mempool) Contains(tx *Transaction) bool {
+	_, ok := (*p).entries[tx.Id()]
+	return ok
+}
+
+func (p *Mempool) ToArray() []*Transaction {
+	var arr []*Transaction
+	for _, entry := range (*p).entries {
+		arr = append(arr, (*entry).tx)
+	}
+	return arr
+}
+
+// Adds tx, evicting the lowest-fee transactions if the pool grows past its
+// limits. Fails if tx would be evicted itself.
+func (p *Mempool) Add(tx *Transaction) error {
+	data, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	entry := mempoolEntry{tx: tx, id: tx.Id(), size: len(data), tailIndex: -1}
+	if _, ok := (*p).entries[entry.id]; ok {
+		return ErrKnownTransaction
+	}
+	if _, ok := (*p).senders[(*tx).Info.From][(*tx).Info.Nonce]; ok {
+		return ErrNonceConflict
+	}
+
+	p.insert(&entry)
+	for len((*p).entries) > (*p).maxCount || (*p).bytes > (*p).maxBytes {
+		victim := p.evictionCandidate()
+		p.remove(victim)
+		if victim == &entry {
+			return ErrMempoolFull
+		}
+	}
+	return nil
+}
+
+// Checks tx against the state at head before adding it. The sender's other
+// transactions waiting in the pool or in template, the block being mined on
+// top of head, must be covered by their balance along with tx.
+//
+// A transaction reusing a pending nonce replaces the pending one if it pays
+// at least MIN_FEE_BUMP more in fees. The replaced transaction is returned;
+// if it is in template, the caller has to rebuild the template without it.
+func (p *Mempool) Admit(tx *Transaction, head *Block, template *Block) (*Transaction, error) {
+	if p.Contains(tx) || (template != nil && template.Contains(tx)) {
+		return nil, ErrKnownTransaction
+	}
+	if len((*tx).Sig) == 0 {
+		return nil, ErrUnsignedTransaction
+	}
+	if !tx.VerifySignature() || GenerateAddress(&(*tx).Info.Pubkey) != (*tx).Info.From {
+		return nil, ErrBadSignature
+	}
+
+	from := (*tx).Info.From
+	expectedNonce := head.NonceOf(from)
+	if (*tx).Info.Nonce < expectedNonce {
+		return nil, fmt.Errorf("%w: nonce %d, expected at least %d", ErrStaleNonce, (*tx).Info.Nonce, expectedNonce)
+	}
+
+	pending := p.senderTransactions(from)
+	if template != nil {
+		for i := range (*template).Transactions {
+			if (*template).Transactions[i].Tx.Info.From == from {
+				pending = append(pending, &(*template).Transactions[i].Tx)
+			}
+		}
+	}
+	spent, err := tx.TotalOutput()
+	if err != nil {
+		return nil, err
+	}
+	var replaced *Transaction
+	for _, other := range pending {
+		if (*other).Info.Nonce < expectedNonce {
+			continue
+		}
+		if (*other).Info.Nonce == (*tx).Info.Nonce {
+			if minFee, err := (*other).Info.Fee.CheckedAdd(MIN_FEE_BUMP); err != nil || (*tx).Info.Fee < minFee {
+				return nil, fmt.Errorf("%w: fee %d, replacing fee %d", ErrReplacementUnderpriced, (*tx).Info.Fee, (*other).Info.Fee)
+			}
+			replaced = other
+			continue
+		}
+		otherSpent, err := other.TotalOutput()
+		if err != nil {
+			return nil, err
+		}
+		if spent, err = spent.CheckedAdd(otherSpent); err != nil {
+			return nil, err
+		}
+	}
+	if balance := head.BalanceOf(from); spent > balance {
+		return nil, fmt.Errorf("%w: spends %d of %d", ErrInsufficientFunds, spent, balance)
+	}
+
+	// A nonce past a gap is held until the missing ones arrive.
+	next := expectedNonce
+	if template != nil {
+		next = template.NonceOf(from)
+	}
+	_, ready, queued := p.splitSender(from, next)
+	if replaced == nil && (*tx).Info.Nonce > next+uint32(len(ready)) && len(queued) >= MEMPOOL_MAX_QUEUED_PER_SENDER {
+		return nil, fmt.Errorf("%w: %d queued", ErrSenderQueueFull, len(queued))
+	}
+
+	var old *mempoolEntry
+	if replaced != nil {
+		old = (*p).entries[replaced.Id()]
+	}
+	if old != nil {
+		p.remove(old)
+	}
+	if err := p.Add(tx); err != nil {
+		if old != nil {
+			p.insert(old)
+		}
+		return nil, err
+	}
+	return replaced, nil
+}
+
+func (p *Mempool) Remove(tx *Transaction) {
+	if entry, ok := (*p).entries[tx.Id()]; ok {
+		p.remove(entry)
+	}
+}
+
+// Brings the pool in line with a reorg. The transactions of the disconnected
+// blocks and of template, the block being mined on the old tip, come back
+// unless the new branch includes them, and those of the connected blocks are
+// dropped. Whatever else the new branch made stale goes on the next FillBlock.
+func (p *Mempool) ApplyReorg(reorg *Reorg, template *Block) {
+	returned := append([]*Block{}, (*reorg).Disconnected...)
+	if template != nil {
+		returned = append(returned, template)
+	}
+	for _, block := range returned {
+		for i := range (*block).Transactions {
+			tx := &(*block).Transactions[i].Tx
+			if !reorg.connects(tx) {
+				p.Add(tx)
+			}
+		}
+	}
+	for _, block := range (*reorg).Connected {
+		for i := range (*block).Transactions {
+			p.Remove(&(*block).Transactions[i].Tx)
+		}
+	}
+}
+
+func (p *Mempool) insert(entry *mempoolEntry) {
+	from := (*entry).tx.Info.From
+	if (*p).senders[from] == nil {
+		(*p).senders[from] = make(map[uint32]*mempoolEntry)
+	}
+	(*p).senders[from][(*entry).tx.Info.Nonce] = entry
+	(*p).entries[(*entry).id] = entry
+	(*p).bytes += (*entry).size
+
+	if tail, ok := (*p).tailOf[from]; !ok || (*entry).tx.Info.Nonce > (*tail).tx.Info.Nonce {
+		if ok {
+			heap.Remove(&(*p).tails, (*tail).tailIndex)
+		}
+		(*p).tailOf[from] = entry
+		heap.Push(&(*p).tails, entry)
+	}
+}
+
+func (p *Mempool) remove(entry *mempoolEntry) {
+	from := (*entry).tx.Info.From
+	delete((*p).senders[from], (*entry).tx.Info.Nonce)
+	if len((*p).senders[from]) == 0 {
+		delete((*p).senders, from)
+	}
+	delete((*p).entries, (*entry).id)
+	(*p).bytes -= (*entry).size
+
+	if (*p).tailOf[from] != entry {
+		return
+	}
+	heap.Remove(&(*p).tails, (*entry).tailIndex)
+	delete((*p).tailOf, from)
+	var tail *mempoolEntry
+	for _, other := range (*p).senders[from] {
+		if tail == nil || (*other).tx.Info.Nonce > (*tail).tx.Info.Nonce {
+			tail = other
+		}
+	}
+	if tail != nil {
+		(*p).tailOf[from] = tail
+		heap.Push(&(*p).tails, tail)
+	}
+}
+
+func (p *Mempool) senderTransactions(from string) []*Transaction {
+	var txs []*Transaction
+	for _, entry := range (*p).senders[from] {
+		txs = append(txs, (*entry).tx)
+	}
+	return txs
+}
+
+// The sender's transactions in nonce order.
+func (p *Mempool) senderEntries(from string) []*mempoolEntry {
+	entries := make([]*mempoolEntry, 0, len((*p).senders[from]))
+	for _, entry := range (*p).senders[from] {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].tx.Info.Nonce < entries[j].tx.Info.Nonce
+	})
+	return entries
+}
+
+// Splits the sender's transactions around next, the nonce their next
+// transaction must use. Those below it are stale, the run starting at it is
+// ready to be mined, and the rest are queued until the gap is filled.
+func (p *Mempool) splitSender(from string, next uint32) (stale []*mempoolEntry, ready []*mempoolEntry, queued []*mempoolEntry) {
+	for _, entry := range p.senderEntries(from) {
+		nonce := (*entry).tx.Info.Nonce
+		if nonce < next {
+			stale = append(stale, entry)
+		} else if nonce == next {
+			ready = append(ready, entry)
+			next++
+		} else {
+			queued = append(queued, entry)
+		}
+	}
+	return stale, ready, queued
+}
+
+// The lowest-fee transaction among each sender's highest nonce, so that
+// eviction never leaves a gap in a sender's nonces.
+func (p *Mempool) evictionCandidate() *mempoolEntry {
+	return (*p).tails[0]
+}
+
+// Min-heap of each sender's highest-nonce entry, the worst first.
+type mempoolTails []*mempoolEntry
+
+func (h mempoolTails) Len() int           { return len(h) }
+func (h mempoolTails) Less(i, j int) bool { return h[j].betterThan(h[i]) }
+func (h mempoolTails) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].tailIndex = i
+	h[j].tailIndex = j
+}
+func (h *mempoolTails) Push(x interface{}) {
+	entry := x.(*mempoolEntry)
+	(*entry).tailIndex = len(*h)
+	*h = append(*h, entry)
+}
+func (h *mempoolTails) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	(*entry).tailIndex = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// A run of one sender's ready transactions that goes into a block as a
+// whole, so that a high-fee transaction can pay for the ones ahead of it
+// (child pays for parent).
+type mempoolPackage struct {
+	entries []*mempoolEntry
+	count   int
+	fee     Amount
+	size    int
+}
+
+// Orders packages by fee per transaction, highest first, then by length so
+// that a transaction is not pulled in unless it pays its way.
+func (a *mempoolPackage) betterThan(b *mempoolPackage) bool {
+	// a.fee/a.count > b.fee/b.count, without dividing.
+	aHi, aLo := bits.Mul64(uint64((*a).fee), uint64((*b).count))
+	bHi, bLo := bits.Mul64(uint64((*b).fee), uint64((*a).count))
+	if aHi != bHi {
+		return aHi > bHi
+	}
+	if aLo != bLo {
+		return aLo > bLo
+	}
+	if (*a).count != (*b).count {
+		return (*a).count < (*b).count
+	}
+	return (*a).entries[0].id < (*b).entries[0].id
+}
+
+// The prefix of a sender's ready transactions with the highest fee per
+// transaction, among those within maxCount transactions and maxBytes bytes.
+// Its count is zero if not even the first transaction fits.
+func bestPackage(entries []*mempoolEntry, maxCount int, maxBytes int) *mempoolPackage {
+	best := mempoolPackage{entries: entries}
+	var fee Amount = 0
+	size := 0
+	for i, entry := range entries {
+		if i+1 > maxCount || size+(*entry).size > maxBytes {
+			break
+		}
+		var err error
+		if fee, err = fee.CheckedAdd((*entry).tx.Info.Fee); err != nil {
+			fee = MAX_AMOUNT
+		}
+		size += (*entry).size
+		candidate := mempoolPackage{entries: entries, count: i + 1, fee: fee, size: size}
+		if best.count == 0 || candidate.betterThan(&best) {
+			best = candidate
+		}
+	}
+	return &best
+}
+
+// Max-heap of the best package of each sender.
+type mempoolQueue []*mempoolPackage
+
+func (q mempoolQueue) Len() int            { return len(q) }
+func (q mempoolQueue) Less(i, j int) bool  { return q[i].betterThan(q[j]) }
+func (q mempoolQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *mempoolQueue) Push(x interface{}) { *q = append(*q, x.(*mempoolPackage)) }
+func (q *mempoolQueue) Pop() interface{} {
+	old := *q
+	pkg := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return pkg
+}
+
+// Adds the best-paying transactions to block, up to maxCount transactions
+// and maxBytes bytes. Each sender's transactions go in nonce order, in
+// packages scored by their fee per transaction, so a low-fee transaction is
+// mined along with a high-fee one that depends on it.
+//
+// Transactions leave the pool once they are in the block, and so do those
+// the block rejects or has already seen the nonce of. Transactions behind a
+// nonce gap stay queued. Returns the transactions added.
+func (p *Mempool) FillBlock(block *Block, maxCount int, maxBytes int) []*Transaction {
+	var queue mempoolQueue
+	for from := range (*p).senders {
+		stale, ready, _ := p.splitSender(from, block.NonceOf(from))
+		for _, entry := range stale {
+			p.remove(entry)
+		}
+		if pkg := bestPackage(ready, maxCount, maxBytes); (*pkg).count > 0 {
+			queue = append(queue, pkg)
+		}
+	}
+	heap.Init(&queue)
+
+	var added []*Transaction
+	size := 0
+	for queue.Len() > 0 && len(added) < maxCount {
+		pkg := heap.Pop(&queue).(*mempoolPackage)
+		// The package was scored with the room left when it was queued, so
+		// it may have to shrink, and then wait its turn again.
+		fresh := bestPackage((*pkg).entries, maxCount-len(added), maxBytes-size)
+		if (*fresh).count == 0 {
+			continue
+		} else if (*fresh).count != (*pkg).count {
+			heap.Push(&queue, fresh)
+			continue
+		}
+
+		rejected := false
+		for _, entry := range (*pkg).entries[:(*pkg).count] {
+			p.remove(entry)
+			if !block.AddTransaction((*entry).tx) {
+				// The sender's later nonces now wait on a gap.
+				rejected = true
+				break
+			}
+			added = append(added, (*entry).tx)
+			size += (*entry).size
+		}
+		if rest := (*pkg).entries[(*pkg).count:]; !rejected && len(rest) > 0 {
+			if next := bestPackage(rest, maxCount-len(added), maxBytes-size); (*next).count > 0 {
+				heap.Push(&queue, next)
+			}
+		}
+	}
+	return added
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+func signedTransaction(privKey *rsa.PrivateKey, nonce uint32, fee Amount) *Transaction {
+	return signedPayment(privKey, nonce, 1, fee)
+}
+
+func signedPayment(privKey *rsa.PrivateKey, nonce uint32, amount Amount, fee Amount) *Transaction {
+	from := GenerateAddress(&privKey.PublicKey)
+	tx, _ := NewTransaction(from, nonce, &privKey.PublicKey, nil, fee, []Output{{Address: "someone", Amount: amount}}, nil)
+	tx.Sign(privKey)
+	return tx
+}
+
+func TestMempoolLimits(t *testing.T) {
+	alice, _, _ := GenerateKeypair()
+	bob, _, _ := GenerateKeypair()
+	carol, _, _ := GenerateKeypair()
+	pool := NewMempool(3, MEMPOOL_MAX_BYTES)
+
+	alice0 := signedTransaction(alice, 0, 5)
+	alice1 := signedTransaction(alice, 1, 1)
+	bob0 := signedTransaction(bob, 0, 3)
+	for _, tx := range []*Transaction{alice0, alice1, bob0} {
+		if err := pool.Add(tx); err != nil {
+			t.Fatalf("Add() Error: %v", err)
+		}
+	}
+	if err := pool.Add(alice0); !errors.Is(err, ErrKnownTransaction) {
+		t.Fatalf("Add() of a known transaction returned %v", err)
+	}
+	if err := pool.Add(signedTransaction(alice, 0, 9)); !errors.Is(err, ErrNonceConflict) {
+		t.Fatalf("Add() of a conflicting nonce returned %v", err)
+	}
+
+	// The lowest fee among each sender's last nonce makes room.
+	if err := pool.Add(signedTransaction(carol, 0, 4)); err != nil {
+		t.Fatalf("Add() Error: %v", err)
+	}
+	if pool.Size() != 3 || pool.Contains(alice1) || !pool.Contains(alice0) {
+		t.Fatalf("Expected alice's nonce 1 to be evicted")
+	}
+	if err := pool.Add(signedTransaction(carol, 1, 0)); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("Add() of the lowest-fee transaction to a full pool returned %v", err)
+	}
+	if pool.Size() != 3 {
+		t.Fatalf("Pool holds %d transactions, expected 3", pool.Size())
+	}
+
+	// The byte limit evicts the same way.
+	data, _ := alice0.MarshalBinary()
+	pool = NewMempool(MEMPOOL_MAX_COUNT, 2*len(data))
+	pool.Add(alice0)
+	pool.Add(bob0)
+	pool.Add(signedTransaction(carol, 0, 4))
+	if pool.Size() != 2 || pool.Contains(bob0) || pool.Bytes() > 2*len(data) {
+		t.Fatalf("Expected bob's transaction to be evicted")
+	}
+}
+
+// The heap of each sender's highest nonce must pick the same victim as going
+// through every sender. Add does not check signatures, so none are made.
+func TestMempoolEvictionCandidate(t *testing.T) {
+	pubKey := rsa.PublicKey{N: big.NewInt(0xc5), E: 65537}
+	random := rand.New(rand.NewSource(1))
+	pool := NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
+	for i := 0; i < 2000; i++ {
+		switch random.Intn(4) {
+		case 0:
+			if pool.Size() > 0 {
+				pool.remove(pool.evictionCandidate())
+			}
+		case 1:
+			if txs := pool.ToArray(); len(txs) > 0 {
+				pool.Remove(txs[random.Intn(len(txs))])
+			}
+		default:
+			from := fmt.Sprintf("sender%d", random.Intn(20))
+			tx, _ := NewTransaction(from, uint32(random.Intn(30)), &pubKey, nil, Amount(random.Intn(10)), []Output{{Address: "someone", Amount: 1}}, nil)
+			pool.Add(tx)
+		}
+
+		var worst *mempoolEntry
+		for from := range pool.senders {
+			entries := pool.senderEntries(from)
+			if last := entries[len(entries)-1]; worst == nil || worst.betterThan(last) {
+				worst = last
+			}
+		}
+		if worst != nil && pool.evictionCandidate() != worst {
+			t.Fatalf("Step %d: eviction candidate is %s, expected %s", i, pool.evictionCandidate().id, worst.id)
+		}
+	}
+}
+
+func TestFillBlock(t *testing.T) {
+	alice, _, _ := GenerateKeypair()
+	bob, _, _ := GenerateKeypair()
+	carol, _, _ := GenerateKeypair()
+	balances := make(map[string]Amount)
+	for _, key := range []*rsa.PrivateKey{alice, bob, carol} {
+		balances[GenerateAddress(&key.PublicKey)] = 100
+	}
+	genesis, config, _ := MakeGenesisDefault(balances)
+
+	alice0 := signedTransaction(alice, 0, 1)
+	alice1 := signedTransaction(alice, 1, 4)
+	bob0 := signedTransaction(bob, 0, 5)
+	carol0 := signedTransaction(carol, 0, 3)
+	pool := NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
+	for _, tx := range []*Transaction{alice1, carol0, alice0, bob0} {
+		pool.Add(tx)
+	}
+
+	// Nothing fits under a byte limit smaller than any transaction.
+	block := NewBlock("miner", genesis, CalculateTarget(12), config.coinbaseAmount)
+	if added := pool.FillBlock(block, BLOCK_MAX_TRANSACTIONS, 10); len(added) != 0 || pool.Size() != 4 {
+		t.Fatalf("Added %d transactions under a 10 byte limit", len(added))
+	}
+
+	// Alice's two transactions average a fee of 2.5, but only her nonce 0
+	// fits after bob's and carol's.
+	added := pool.FillBlock(block, 3, BLOCK_MAX_BYTES)
+	expected := []*Transaction{bob0, carol0, alice0}
+	if len(added) != len(expected) {
+		t.Fatalf("Added %d transactions, expected %d", len(added), len(expected))
+	}
+	for i := range expected {
+		if added[i] != expected[i] || !block.Contains(expected[i]) {
+			t.Fatalf("Transaction %d is %s, expected %s", i, added[i].Id(), expected[i].Id())
+		}
+	}
+	if pool.Size() != 1 || !pool.Contains(alice1) {
+		t.Fatalf("Expected only alice's nonce 1 to be left over")
+	}
+
+	// The leftover goes into the next block, and a replay is dropped.
+	pool.Add(bob0)
+	next := NewBlock("miner", block, CalculateTarget(12), config.coinbaseAmount)
+	added = pool.FillBlock(next, BLOCK_MAX_TRANSACTIONS, BLOCK_MAX_BYTES)
+	if len(added) != 1 || added[0] != alice1 || pool.Size() != 0 {
+		t.Fatalf("Expected only alice's nonce 1 in the next block")
+	}
+}
+
+func TestMempoolAdmission(t *testing.T) {
+	alice, _, _ := GenerateKeypair()
+	bob, _, _ := GenerateKeypair()
+	aliceAddr := GenerateAddress(&alice.PublicKey)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{aliceAddr: 100})
+	template := NewBlock("miner", genesis, CalculateTarget(12), config.coinbaseAmount)
+	pool := NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
+
+	unsigned, _ := NewTransaction(aliceAddr, 0, &alice.PublicKey, nil, 1, []Output{{Address: "someone", Amount: 1}}, nil)
+	if _, err := pool.Admit(unsigned, genesis, template); !errors.Is(err, ErrUnsignedTransaction) {
+		t.Fatalf("Admit() of an unsigned transaction returned %v", err)
+	}
+	tampered := signedTransaction(alice, 0, 1)
+	tampered.Info.Outputs[0].Amount = 50
+	if _, err := pool.Admit(tampered, genesis, template); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("Admit() of a tampered transaction returned %v", err)
+	}
+	// Bob signs for his own key but claims to spend alice's gold.
+	forged, _ := NewTransaction(aliceAddr, 0, &bob.PublicKey, nil, 1, []Output{{Address: "someone", Amount: 1}}, nil)
+	forged.Sign(bob)
+	if _, err := pool.Admit(forged, genesis, template); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("Admit() of a forged sender returned %v", err)
+	}
+
+	// Transactions already in the template count against the balance too.
+	alice0 := signedTransaction(alice, 0, 1)
+	template.AddTransaction(alice0)
+	if _, err := pool.Admit(alice0, genesis, template); !errors.Is(err, ErrKnownTransaction) {
+		t.Fatalf("Admit() of a transaction in the template returned %v", err)
+	}
+	if _, err := pool.Admit(signedPayment(alice, 0, 2, 1), genesis, template); !errors.Is(err, ErrReplacementUnderpriced) {
+		t.Fatalf("Admit() of a nonce taken by the template returned %v", err)
+	}
+	if _, err := pool.Admit(signedPayment(alice, 1, 89, 1), genesis, template); err != nil {
+		t.Fatalf("Admit() Error: %v", err)
+	}
+	if _, err := pool.Admit(signedPayment(alice, 2, 8, 1), genesis, template); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("Admit() of an overspending transaction returned %v", err)
+	}
+	if _, err := pool.Admit(signedPayment(alice, 2, 7, 1), genesis, template); err != nil {
+		t.Fatalf("Admit() Error: %v", err)
+	}
+
+	// Once the template is the head, its nonce is used up.
+	next := NewBlock("miner", template, CalculateTarget(12), config.coinbaseAmount)
+	if _, err := pool.Admit(signedTransaction(alice, 0, 3), template, next); !errors.Is(err, ErrStaleNonce) {
+		t.Fatalf("Admit() of a replayed nonce returned %v", err)
+	}
+}
+
+func TestQueuedTransactions(t *testing.T) {
+	alice, _, _ := GenerateKeypair()
+	aliceAddr := GenerateAddress(&alice.PublicKey)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{aliceAddr: 1000})
+	pool := NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
+
+	// Later nonces that arrive first wait for the gap to be filled.
+	alice2 := signedTransaction(alice, 2, 1)
+	alice1 := signedTransaction(alice, 1, 1)
+	for _, tx := range []*Transaction{alice2, alice1} {
+		if _, err := pool.Admit(tx, genesis, nil); err != nil {
+			t.Fatalf("Admit() Error: %v", err)
+		}
+	}
+	block := NewBlock("miner", genesis, CalculateTarget(12), config.coinbaseAmount)
+	if added := pool.FillBlock(block, BLOCK_MAX_TRANSACTIONS, BLOCK_MAX_BYTES); len(added) != 0 || pool.Size() != 2 {
+		t.Fatalf("Added %d transactions ahead of the gap", len(added))
+	}
+
+	alice0 := signedTransaction(alice, 0, 1)
+	pool.Admit(alice0, genesis, nil)
+	added := pool.FillBlock(block, BLOCK_MAX_TRANSACTIONS, BLOCK_MAX_BYTES)
+	if len(added) != 3 || added[0] != alice0 || added[1] != alice1 || added[2] != alice2 || pool.Size() != 0 {
+		t.Fatalf("Expected nonces 0, 1 and 2 once the gap was filled")
+	}
+
+	// Each sender only gets so many queued transactions, but filling the gap
+	// is always allowed.
+	for i := 0; i < MEMPOOL_MAX_QUEUED_PER_SENDER; i++ {
+		if _, err := pool.Admit(signedTransaction(alice, uint32(5+i), 1), block, nil); err != nil {
+			t.Fatalf("Admit() Error: %v", err)
+		}
+	}
+	tooMany := signedTransaction(alice, uint32(5+MEMPOOL_MAX_QUEUED_PER_SENDER), 1)
+	if _, err := pool.Admit(tooMany, block, nil); !errors.Is(err, ErrSenderQueueFull) {
+		t.Fatalf("Admit() past the queue limit returned %v", err)
+	}
+	if _, err := pool.Admit(signedTransaction(alice, 3, 1), block, nil); err != nil {
+		t.Fatalf("Admit() of a gap-filling transaction returned %v", err)
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	alice, _, _ := GenerateKeypair()
+	aliceAddr := GenerateAddress(&alice.PublicKey)
+	genesis, _, _ := MakeGenesisDefault(map[string]Amount{aliceAddr: 10})
+	pool := NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
+
+	original := signedPayment(alice, 0, 8, 1)
+	pool.Admit(original, genesis, nil)
+	if _, err := pool.Admit(signedPayment(alice, 0, 7, 1), genesis, nil); !errors.Is(err, ErrReplacementUnderpriced) {
+		t.Fatalf("Admit() of a replacement without a higher fee returned %v", err)
+	}
+
+	// The replaced transaction no longer counts against the balance.
+	replacement := signedPayment(alice, 0, 8, 1+MIN_FEE_BUMP)
+	replaced, err := pool.Admit(replacement, genesis, nil)
+	if err != nil {
+		t.Fatalf("Admit() Error: %v", err)
+	}
+	if replaced != original || pool.Size() != 1 || !pool.Contains(replacement) {
+		t.Fatalf("Expected the replacement to take the original's place")
+	}
+}
+
+func TestPackageSelection(t *testing.T) {
+	alice, _, _ := GenerateKeypair()
+	bob, _, _ := GenerateKeypair()
+	carol, _, _ := GenerateKeypair()
+	balances := make(map[string]Amount)
+	for _, key := range []*rsa.PrivateKey{alice, bob, carol} {
+		balances[GenerateAddress(&key.PublicKey)] = 100
+	}
+	aliceAddr := GenerateAddress(&alice.PublicKey)
+	bobAddr := GenerateAddress(&bob.PublicKey)
+	carolAddr := GenerateAddress(&carol.PublicKey)
+	genesis, config, _ := MakeGenesisDefault(balances)
+
+	// Alice's nonce 1 pays for her low-fee nonce 0, and the pair beats the
+	// others' single transactions.
+	alice0 := signedTransaction(alice, 0, 1)
+	alice1 := signedTransaction(alice, 1, 20)
+	bob0 := signedTransaction(bob, 0, 5)
+	carol0 := signedTransaction(carol, 0, 4)
+	fill := func(maxCount int) (*Block, []*Transaction) {
+		pool := NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
+		for _, tx := range []*Transaction{alice0, alice1, bob0, carol0} {
+			pool.Add(tx)
+		}
+		block := NewBlock("miner", genesis, CalculateTarget(12), config.coinbaseAmount)
+		return block, pool.FillBlock(block, maxCount, BLOCK_MAX_BYTES)
+	}
+
+	block, added := fill(3)
+	if len(added) != 3 || added[0] != alice0 || added[1] != alice1 || added[2] != bob0 {
+		t.Fatalf("Expected alice's package ahead of bob")
+	}
+	if block.NonceOf(aliceAddr) != 2 || block.NonceOf(bobAddr) != 1 || block.NonceOf(carolAddr) != 0 {
+		t.Fatalf("Next nonces are %d, %d, %d, expected 2, 1, 0", block.NonceOf(aliceAddr), block.NonceOf(bobAddr), block.NonceOf(carolAddr))
+	}
+
+	// With room for one transaction the package only counts nonce 0's fee.
+	block, added = fill(1)
+	if len(added) != 1 || added[0] != bob0 || block.NonceOf(aliceAddr) != 0 {
+		t.Fatalf("Expected only bob's transaction when alice's package does not fit")
+	}
+}
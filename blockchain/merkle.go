@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// One step of a Merkle branch: the sibling hash at that level, and whether
+// the sibling sits to the left of the running hash.
+type MerkleStep struct {
+	Hash string
+	Left bool
+}
+
+// Leaves and inner nodes are hashed with different prefixes, so an inner node
+// can never be passed off as a leaf.
+func merkleLeaf(item []byte) []byte {
+	hashed := sha256.Sum256(append([]byte{0x00}, item...))
+	return hashed[:]
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	data := append([]byte{0x01}, left...)
+	data = append(data, right...)
+	hashed := sha256.Sum256(data)
+	return hashed[:]
+}
+
+// Hashes one level of the tree into the next. A node without a sibling is
+// promoted to the next level unchanged rather than paired with itself.
+func merkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		} else {
+			next = append(next, level[i])
+		}
+	}
+	return next
+}
+
+// Computes the Merkle root over the items. The root of no items is all zeros.
+func MerkleRoot(items [][]byte) []byte {
+	if len(items) == 0 {
+		return make([]byte, sha256.Size)
+	}
+	level := make([][]byte, len(items))
+	for i, item := range items {
+		level[i] = merkleLeaf(item)
+	}
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+// Collects the sibling hashes needed to connect items[index] to the root.
+func MerkleBranch(items [][]byte, index int) []MerkleStep {
+	level := make([][]byte, len(items))
+	for i, item := range items {
+		level[i] = merkleLeaf(item)
+	}
+
+	branch := make([]MerkleStep, 0)
+	for len(level) > 1 {
+		if index%2 == 1 {
+			branch = append(branch, MerkleStep{Hash: hex.EncodeToString(level[index-1]), Left: true})
+		} else if index+1 < len(level) {
+			branch = append(branch, MerkleStep{Hash: hex.EncodeToString(level[index+1]), Left: false})
+		}
+		level = merkleLevel(level)
+		index = index / 2
+	}
+	return branch
+}
+
+// Checks that the item is a leaf of the tree with the given root.
+func VerifyMerkleBranch(item []byte, branch []MerkleStep, root []byte) bool {
+	hashed := merkleLeaf(item)
+	for _, step := range branch {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			hashed = merkleNode(sibling, hashed)
+		} else {
+			hashed = merkleNode(hashed, sibling)
+		}
+	}
+	return bytes.Equal(hashed, root)
+}
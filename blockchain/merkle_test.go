@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleBranch(t *testing.T) {
+	for size := 1; size <= 9; size++ {
+		items := make([][]byte, size)
+		for i := range items {
+			items[i] = []byte(fmt.Sprintf("item %d", i))
+		}
+		root := MerkleRoot(items)
+
+		for i := range items {
+			branch := MerkleBranch(items, i)
+			if !VerifyMerkleBranch(items[i], branch, root) {
+				t.Fatalf("Branch for item %d of %d does not verify", i, size)
+			}
+			if VerifyMerkleBranch([]byte("other"), branch, root) {
+				t.Fatalf("Branch for item %d of %d verifies a different item", i, size)
+			}
+		}
+
+		// Changing any item changes the root.
+		items[size-1] = []byte("changed")
+		if bytes.Equal(MerkleRoot(items), root) {
+			t.Fatalf("Root of %d items did not change", size)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -25,7 +26,7 @@ func TestNewMiner(t *testing.T) {
 	address4 := GenerateAddress(pubKey4)
 	address5 := GenerateAddress(pubKey5)
 	address6 := GenerateAddress(pubKey6)
-	newBalances := make(map[string]uint32)
+	newBalances := make(map[string]Amount)
 	newBalances[address1] = 233
 	newBalances[address2] = 99
 	newBalances[address3] = 67
@@ -34,9 +35,9 @@ func TestNewMiner(t *testing.T) {
 
 	genesis, config, _ := MakeGenesisDefault(newBalances)
 
-	client1 := NewClient("Alice", net, genesis, privKey1)
-	client2 := NewClient("Bob", net, genesis, privKey2)
-	client3 := NewClient("Cindy", net, genesis, privKey3)
+	client1 := NewClient("Alice", net, genesis, privKey1, config)
+	client2 := NewClient("Bob", net, genesis, privKey2, config)
+	client3 := NewClient("Cindy", net, genesis, privKey3, config)
 	miner1 := NewMiner("Minnie", net, NUM_ROUNDS_MINING, genesis, privKey4, config)
 	miner2 := NewMiner("Mickey", net, NUM_ROUNDS_MINING, genesis, privKey5, config)
 	miner3 := NewMiner("Donald", net, NUM_ROUNDS_MINING, genesis, privKey6, config)
@@ -115,3 +116,95 @@ func TestNewMiner(t *testing.T) {
 	fmt.Println("End!")
 	//os.Exit(0)
 }
+
+func TestPostTransactionRejected(t *testing.T) {
+	privKey, pubKey, _ := GenerateKeypair()
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{GenerateAddress(pubKey): 100})
+	miner := NewMiner("Minnie", NewFakeNet(), NUM_ROUNDS_MINING, genesis, privKey, config)
+	miner.StartNewSearch(nil)
+
+	// Overspending is reported to the caller instead of panicking, and
+	// nothing is recorded or relayed.
+	if _, err := miner.PostTransaction([]Output{{Address: "someone", Amount: 100}}, 1); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("PostTransaction() returned %v, expected ErrInsufficientFunds", err)
+	}
+	if miner.Nonce != 0 || len(miner.PendingOutgoingTransactions) != 0 {
+		t.Fatalf("A rejected transaction was recorded")
+	}
+	tx, err := miner.PostTransaction([]Output{{Address: "someone", Amount: 10}}, 1)
+	if err != nil {
+		t.Fatalf("PostTransaction() Error: %v", err)
+	}
+	if miner.Nonce != 1 || !miner.CurrentBlock.Contains(tx) && !miner.Mempool.Contains(tx) {
+		t.Fatalf("An accepted transaction was not queued for mining")
+	}
+
+	// A replay of a transaction already being mined is refused.
+	if err := miner.AddTransaction(tx); !errors.Is(err, ErrKnownTransaction) {
+		t.Fatalf("AddTransaction() of a known transaction returned %v", err)
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	privKey, pubKey, _ := GenerateKeypair()
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{GenerateAddress(pubKey): 100})
+	miner := NewMiner("Minnie", NewFakeNet(), NUM_ROUNDS_MINING, genesis, privKey, config)
+	miner.StartNewSearch(nil)
+
+	tx, _ := miner.PostTransaction([]Output{{Address: "someone", Amount: 10}}, 1)
+	miner.StartNewSearch(nil)
+	if !miner.CurrentBlock.Contains(tx) {
+		t.Fatalf("Posted transaction is not in the template")
+	}
+
+	if _, err := miner.BumpFee("missing", 5); !errors.Is(err, ErrNotPending) {
+		t.Fatalf("BumpFee() of an unknown transaction returned %v", err)
+	}
+	if _, err := miner.BumpFee(tx.Id(), 1); !errors.Is(err, ErrReplacementUnderpriced) {
+		t.Fatalf("BumpFee() without a higher fee returned %v", err)
+	}
+
+	// The replacement takes the original's place in the wallet and in the
+	// template being mined.
+	bumped, err := miner.BumpFee(tx.Id(), 5)
+	if err != nil {
+		t.Fatalf("BumpFee() Error: %v", err)
+	}
+	if bumped.Info.Nonce != tx.Info.Nonce || bumped.Info.Fee != 5 {
+		t.Fatalf("Replacement has nonce %d and fee %d", bumped.Info.Nonce, bumped.Info.Fee)
+	}
+	if len(miner.PendingOutgoingTransactions) != 1 || miner.PendingOutgoingTransactions[bumped.Id()] != bumped {
+		t.Fatalf("Wallet still holds the superseded transaction")
+	}
+	if miner.CurrentBlock.Contains(tx) || !miner.CurrentBlock.Contains(bumped) {
+		t.Fatalf("Template was not rebuilt with the replacement")
+	}
+}
+
+func TestStartNewSearchDropsTemplate(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{"whale": MAX_AMOUNT})
+	minerKey, _, _ := GenerateKeypair()
+	miner := NewMiner("Minnie", NewFakeNet(), NUM_ROUNDS_MINING, genesis, minerKey, config)
+	miner.StartNewSearch(nil)
+	cancel := miner.searchCancel
+
+	// Paying the reward of this head overflows, so no block can be built on
+	// it. The old template builds on a stale head, so it is not kept either.
+	head := NewBlock("whale", genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	miner.LastBlock = head
+	miner.StartNewSearch(nil)
+	if miner.CurrentBlock != nil {
+		t.Fatalf("Kept mining a template on a stale head")
+	}
+	select {
+	case <-cancel:
+	default:
+		t.Fatalf("Search of the stale template was not cancelled")
+	}
+
+	// FindProof idles rather than mining nothing.
+	miner.FindProof(true)
+	if miner.Hashrate() != 0 {
+		t.Fatalf("FindProof() searched without a template")
+	}
+}
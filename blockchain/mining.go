@@ -0,0 +1,136 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of proofs a worker tries between checks for cancellation.
+const MINING_CHUNK uint32 = 1000
+
+// Transactions paying at least this fee interrupt the search, so that they
+// go into the block being mined rather than waiting for the next one.
+const DEFAULT_PREEMPT_FEE Amount = 10
+
+// How a miner spends its CPU. Each worker searches its own part of the
+// proof range, and CpuLimit is the share of time, in percent, that a worker
+// may spend hashing before it pauses.
+type MiningOptions struct {
+	Workers    int
+	CpuLimit   int
+	PreemptFee Amount
+}
+
+func DefaultMiningOptions() MiningOptions {
+	return MiningOptions{Workers: 1, CpuLimit: 100, PreemptFee: DEFAULT_PREEMPT_FEE}
+}
+
+// Keeps the options within what the machine can actually run.
+func NewMiningOptions(workers int, cpuLimit int) MiningOptions {
+	if workers < 1 {
+		workers = 1
+	} else if workers > runtime.NumCPU() {
+		workers = runtime.NumCPU()
+	}
+	if cpuLimit < 1 {
+		cpuLimit = 1
+	} else if cpuLimit > 100 {
+		cpuLimit = 100
+	}
+	return MiningOptions{Workers: workers, CpuLimit: cpuLimit, PreemptFee: DEFAULT_PREEMPT_FEE}
+}
+
+type SearchResult struct {
+	Found bool
+	Proof uint32
+	// The first proof that was not searched, where the next batch starts.
+	// It is 2^32 once the whole proof space has been searched.
+	Next    uint64
+	Hashes  uint64
+	Elapsed time.Duration
+}
+
+func (result *SearchResult) Hashrate() float64 {
+	if (*result).Elapsed <= 0 {
+		return 0
+	}
+	return float64((*result).Hashes) / (*result).Elapsed.Seconds()
+}
+
+// Searches up to rounds proofs from start, splitting them into disjoint
+// ranges, one per worker. The search stops as soon as a worker finds a proof
+// or cancel is closed.
+func (search *ProofSearch) Run(start uint32, rounds uint32, options MiningOptions, cancel <-chan struct{}) SearchResult {
+	begin := time.Now()
+	end := uint64(start) + uint64(rounds)
+	if end > 1<<32 {
+		end = 1 << 32
+	}
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var hashes uint64
+	var once sync.Once
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	found := make(chan uint32, workers)
+
+	span := end - uint64(start)
+	for w := 0; w < workers; w++ {
+		lo := uint64(start) + span*uint64(w)/uint64(workers)
+		hi := uint64(start) + span*uint64(w+1)/uint64(workers)
+		wg.Add(1)
+		// Each worker gets its own copy of the serialized header.
+		go func(worker ProofSearch, lo uint64, hi uint64) {
+			defer wg.Done()
+			for proof := lo; proof < hi; {
+				started := time.Now()
+				first := proof
+				chunkEnd := proof + uint64(MINING_CHUNK)
+				if chunkEnd > hi {
+					chunkEnd = hi
+				}
+				for ; proof < chunkEnd; proof++ {
+					if worker.Check(uint32(proof)) {
+						atomic.AddUint64(&hashes, proof-first+1)
+						found <- uint32(proof)
+						once.Do(func() { close(stop) })
+						return
+					}
+				}
+				atomic.AddUint64(&hashes, chunkEnd-first)
+				select {
+				case <-stop:
+					return
+				case <-cancel:
+					return
+				default:
+				}
+				if options.CpuLimit > 0 && options.CpuLimit < 100 {
+					pause := time.Since(started) * time.Duration(100-options.CpuLimit) / time.Duration(options.CpuLimit)
+					select {
+					case <-stop:
+						return
+					case <-cancel:
+						return
+					case <-time.After(pause):
+					}
+				}
+			}
+		}(*search, lo, hi)
+	}
+	wg.Wait()
+
+	result := SearchResult{Next: end, Hashes: atomic.LoadUint64(&hashes), Elapsed: time.Since(begin)}
+	select {
+	case proof := <-found:
+		result.Found = true
+		result.Proof = proof
+	default:
+	}
+	return result
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParallelSearch(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	block := NewBlock("miner", genesis, CalculateTarget(12), config.coinbaseAmount)
+	search, _ := block.NewProofSearch()
+
+	// Four workers find a proof that the block itself accepts.
+	result := search.Run(0, 1<<20, NewMiningOptions(4, 100), nil)
+	if !result.Found {
+		t.Fatalf("No proof found in %d hashes", result.Hashes)
+	}
+	block.Proof = result.Proof
+	if !block.hasValidProof() {
+		t.Fatalf("Proof %d is not valid", result.Proof)
+	}
+
+	// With an impossible target the workers cover the whole range between
+	// them, exactly once.
+	block.Target = *big.NewInt(0)
+	search, _ = block.NewProofSearch()
+	result = search.Run(100, 10000, MiningOptions{Workers: 3, CpuLimit: 100}, nil)
+	if result.Found || result.Hashes != 10000 || result.Next != 10100 {
+		t.Fatalf("Searched %d proofs up to %d, expected 10000 up to 10100", result.Hashes, result.Next)
+	}
+
+	// A cancelled search stops after its current chunk.
+	cancel := make(chan struct{})
+	close(cancel)
+	result = search.Run(0, 1<<30, MiningOptions{Workers: 2, CpuLimit: 100}, cancel)
+	if result.Hashes > 2*uint64(MINING_CHUNK) {
+		t.Fatalf("Cancelled search tried %d proofs", result.Hashes)
+	}
+}
+
+func TestExtraNonce(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	miner := NewMiner("Minnie", NewFakeNet(), 2000, genesis, nil, config)
+	miner.StartNewSearch(nil)
+
+	// No proof can meet a zero target, so the miner must run through the
+	// end of the proof space and carry on with the next extra nonce.
+	block := miner.CurrentBlock
+	block.Target = *big.NewInt(0)
+	block.Proof = math.MaxUint32 - 1500
+	before := block.GetHashStr()
+
+	miner.FindProof(true)
+	if block.ExtraNonce != 1 || block.Proof != 0 {
+		t.Fatalf("Search stopped at extra nonce %d, proof %d", block.ExtraNonce, block.Proof)
+	}
+	block.Proof = math.MaxUint32 - 1500
+	if block.GetHashStr() == before {
+		t.Fatalf("Bumping the extra nonce did not change the header hash")
+	}
+	block.Proof = 0
+
+	miner.FindProof(true)
+	if block.ExtraNonce != 1 || block.Proof != 2000 {
+		t.Fatalf("Search stopped at extra nonce %d, proof %d, expected 1, 2000", block.ExtraNonce, block.Proof)
+	}
+}
+
+func TestPreemptSearch(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	privKey2, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 100, address2: 100})
+	miner := NewMiner("Minnie", NewFakeNet(), math.MaxUint32, genesis, nil, config)
+	miner.StartNewSearch(nil)
+	miner.CurrentBlock.Target = *big.NewInt(0)
+
+	done := make(chan struct{})
+	go func() {
+		miner.FindProof(true)
+		close(done)
+	}()
+	// Wait until the search watches the current cancel channel, since a
+	// preemption before that would go unnoticed and the search would run on.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		miner.mu.Lock()
+		started := miner.searching != nil && miner.searching == miner.searchCancel
+		miner.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Search did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The node lock is free while the workers hash, so a low-fee transaction
+	// is queued right away without disturbing the search.
+	lowFee, _ := NewTransaction(address1, 0, pubKey1, nil, 1, []Output{{Address: address2, Amount: 10}}, nil)
+	lowFee.Sign(privKey1)
+	added := make(chan struct{})
+	go func() {
+		miner.AddTransaction(lowFee)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AddTransaction blocked behind the search")
+	}
+	select {
+	case <-done:
+		t.Fatalf("A low-fee transaction interrupted the search")
+	default:
+	}
+
+	// A high-fee transaction cancels the search and joins a new template.
+	highFee, _ := NewTransaction(address2, 0, pubKey2, nil, DEFAULT_PREEMPT_FEE, []Output{{Address: address1, Amount: 10}}, nil)
+	highFee.Sign(privKey2)
+	miner.AddTransaction(highFee)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("A high-fee transaction did not interrupt the search")
+	}
+	if !miner.CurrentBlock.Contains(highFee) || miner.CurrentBlock.Contains(lowFee) {
+		t.Fatalf("The new template should hold only the high-fee transaction")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Limits on the blocks kept while their parent is missing.
+const ORPHAN_MAX_COUNT int = 256
+const ORPHAN_MAX_BYTES int = 16 << 20
+const ORPHAN_MAX_PER_PEER int = 32
+
+// Orphans whose parent has not turned up within this long are dropped.
+const ORPHAN_EXPIRY time.Duration = 10 * time.Minute
+
+var ErrKnownOrphan = errors.New("orphan block is already held")
+var ErrOrphanWork = errors.New("orphan block does not carry enough proof-of-work")
+var ErrOrphanQuota = errors.New("peer has too many orphan blocks")
+var ErrOrphanPoolFull = errors.New("orphan pool is full")
+
+type orphanEntry struct {
+	block *Block
+	hash  string
+	peer  string
+	size  int
+	added time.Time
+}
+
+// Blocks received before their parent, indexed by hash and by parent hash.
+// Every peer gets a quota, and once the pool is full the peer holding the
+// most orphans loses its oldest one, so a peer sending made-up blocks only
+// pushes out its own. It is not safe for concurrent use; the node's lock guards
+// it.
+type OrphanPool struct {
+	entries    map[string]*orphanEntry
+	byParent   map[string]map[string]*orphanEntry
+	byPeer     map[string]int
+	order      []*orphanEntry
+	bytes      int
+	maxCount   int
+	maxBytes   int
+	maxPerPeer int
+	expiry     time.Duration
+}
+
+func NewOrphanPool(maxCount int, maxBytes int, maxPerPeer int, expiry time.Duration) *OrphanPool {
+	var p OrphanPool
+	p.entries = make(map[string]*orphanEntry)
+	p.byParent = make(map[string]map[string]*orphanEntry)
+	p.byPeer = make(map[string]int)
+	p.maxCount = maxCount
+	p.maxBytes = maxBytes
+	p.maxPerPeer = maxPerPeer
+	p.expiry = expiry
+	return &p
+}
+
+func (p *OrphanPool) Len() int {
+	return len((*p).entries)
+}
+
+func (p *OrphanPool) Bytes() int {
+	return (*p).bytes
+}
+
+func (p *OrphanPool) Contains(hash string) bool {
+	_, ok := (*p).entries[hash]
+	return ok
+}
+
+// The easiest target an orphan may claim. Its parent is unknown, so its
+// target cannot be checked exactly, but no chain we would switch to can have
+// eased by more than one retarget from our head.
+func orphanTargetLimit(head *Block) *big.Int {
+	limit := new(big.Int).Mul(&(*head).Target, big.NewInt(MAX_RETARGET_FACTOR))
+	if maxTarget := CalculateTarget(0); limit.Cmp(maxTarget) > 0 {
+		limit = maxTarget
+	}
+	return limit
+}
+
+// Holds block, received from peer, until its parent arrives. The proof is
+// checked first, against a target no easier than orphanTargetLimit(head).
+// An empty peer stands for a sender that cannot be told apart from others,
+// such as a FakeNet node; it is only held to the pool's overall limits.
+// Returns whether the parent was not already awaited, in which case the
+// caller should ask for it.
+func (p *OrphanPool) Add(block *Block, peer string, head *Block) (bool, error) {
+	p.Expire(time.Now())
+
+	hash := block.GetHashStr()
+	if p.Contains(hash) {
+		return false, ErrKnownOrphan
+	}
+	if (*block).Target.Cmp(orphanTargetLimit(head)) > 0 {
+		return false, fmt.Errorf("%w: target %x is too easy", ErrOrphanWork, &(*block).Target)
+	}
+	if !block.hasValidProof() {
+		return false, ErrOrphanWork
+	}
+	if peer != "" && (*p).byPeer[peer] >= (*p).maxPerPeer {
+		return false, fmt.Errorf("%w: %d held", ErrOrphanQuota, (*p).byPeer[peer])
+	}
+	data, err := block.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+
+	entry := orphanEntry{block: block, hash: hash, peer: peer, size: len(data), added: time.Now()}
+	_, awaited := (*p).byParent[(*block).PrevBlockHash]
+	p.insert(&entry)
+	for len((*p).entries) > (*p).maxCount || (*p).bytes > (*p).maxBytes {
+		victim := p.evictionVictim()
+		p.remove(victim)
+		if victim == &entry {
+			return false, ErrOrphanPoolFull
+		}
+	}
+	return !awaited, nil
+}
+
+// The oldest orphan of the peer holding the most.
+func (p *OrphanPool) evictionVictim() *orphanEntry {
+	most := 0
+	for _, count := range (*p).byPeer {
+		if count > most {
+			most = count
+		}
+	}
+	for _, entry := range (*p).order {
+		if (*p).byPeer[(*entry).peer] == most {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Removes and returns the orphans waiting on parentHash.
+func (p *OrphanPool) TakeChildren(parentHash string) []*Block {
+	var children []*Block
+	for _, entry := range (*p).byParent[parentHash] {
+		children = append(children, (*entry).block)
+		p.remove(entry)
+	}
+	return children
+}
+
+// Drops the orphans added more than the expiry before now, returning how
+// many there were.
+func (p *OrphanPool) Expire(now time.Time) int {
+	expired := 0
+	for len((*p).order) > 0 && now.Sub((*p).order[0].added) > (*p).expiry {
+		p.remove((*p).order[0])
+		expired++
+	}
+	return expired
+}
+
+func (p *OrphanPool) insert(entry *orphanEntry) {
+	parent := (*entry).block.PrevBlockHash
+	if (*p).byParent[parent] == nil {
+		(*p).byParent[parent] = make(map[string]*orphanEntry)
+	}
+	(*p).byParent[parent][(*entry).hash] = entry
+	(*p).entries[(*entry).hash] = entry
+	(*p).byPeer[(*entry).peer]++
+	(*p).order = append((*p).order, entry)
+	(*p).bytes += (*entry).size
+}
+
+func (p *OrphanPool) remove(entry *orphanEntry) {
+	parent := (*entry).block.PrevBlockHash
+	delete((*p).byParent[parent], (*entry).hash)
+	if len((*p).byParent[parent]) == 0 {
+		delete((*p).byParent, parent)
+	}
+	delete((*p).entries, (*entry).hash)
+	(*p).byPeer[(*entry).peer]--
+	if (*p).byPeer[(*entry).peer] == 0 {
+		delete((*p).byPeer, (*entry).peer)
+	}
+	for i, other := range (*p).order {
+		if other == entry {
+			(*p).order = append((*p).order[:i], (*p).order[i+1:]...)
+			break
+		}
+	}
+	(*p).bytes -= (*entry).size
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOrphanPool(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	b1 := minedBlock(t, genesis, config, "miner")
+	b2 := minedBlock(t, b1, config, "miner")
+	b3 := minedBlock(t, b2, config, "miner")
+	sibling := minedBlock(t, b2, config, "other")
+	b4 := minedBlock(t, b3, config, "miner")
+
+	pool := NewOrphanPool(3, ORPHAN_MAX_BYTES, 2, time.Minute)
+	if newParent, err := pool.Add(b2, "peer1", genesis); err != nil || !newParent {
+		t.Fatalf("Add() returned %v, %v", newParent, err)
+	}
+	if _, err := pool.Add(b2, "peer1", genesis); !errors.Is(err, ErrKnownOrphan) {
+		t.Fatalf("Add() of a held orphan returned %v", err)
+	}
+
+	// Orphans must carry real work: a valid proof, and a target close to
+	// our head's.
+	easy := NewBlock("miner", b1, CalculateTarget(0), config.coinbaseAmount)
+	if _, err := pool.Add(easy, "peer1", genesis); !errors.Is(err, ErrOrphanWork) {
+		t.Fatalf("Add() of an orphan with an easy target returned %v", err)
+	}
+	forged := b3.Clone()
+	for forged.hasValidProof() {
+		forged.Proof++
+	}
+	if _, err := pool.Add(forged, "peer1", genesis); !errors.Is(err, ErrOrphanWork) {
+		t.Fatalf("Add() of an orphan without a valid proof returned %v", err)
+	}
+
+	// Each peer has a quota, and the parent is only asked for once.
+	if newParent, err := pool.Add(b3, "peer1", genesis); err != nil || !newParent {
+		t.Fatalf("Add() returned %v, %v", newParent, err)
+	}
+	if _, err := pool.Add(sibling, "peer1", genesis); !errors.Is(err, ErrOrphanQuota) {
+		t.Fatalf("Add() over the peer quota returned %v", err)
+	}
+	if newParent, err := pool.Add(sibling, "peer2", genesis); err != nil || newParent {
+		t.Fatalf("Add() returned %v, %v", newParent, err)
+	}
+
+	// Once full, the peer holding the most orphans loses its oldest.
+	if _, err := pool.Add(b4, "peer3", genesis); err != nil {
+		t.Fatalf("Add() Error: %v", err)
+	}
+	if pool.Len() != 3 || pool.Contains(b2.GetHashStr()) {
+		t.Fatalf("Oldest orphan was not evicted")
+	}
+
+	children := pool.TakeChildren(b2.GetHashStr())
+	if len(children) != 2 || pool.Len() != 1 || pool.Contains(b3.GetHashStr()) {
+		t.Fatalf("TakeChildren() returned %d blocks, leaving %d", len(children), pool.Len())
+	}
+
+	if pool.Expire(time.Now()) != 0 || pool.Expire(time.Now().Add(2*time.Minute)) != 1 {
+		t.Fatalf("Orphans did not expire")
+	}
+	if pool.Len() != 0 || pool.Bytes() != 0 {
+		t.Fatalf("Expired pool still holds %d orphans in %d bytes", pool.Len(), pool.Bytes())
+	}
+
+	// An older orphan of a peer holding fewer is kept.
+	pool = NewOrphanPool(3, ORPHAN_MAX_BYTES, 2, time.Minute)
+	pool.Add(sibling, "peer2", genesis)
+	pool.Add(b2, "peer1", genesis)
+	pool.Add(b3, "peer1", genesis)
+	if _, err := pool.Add(b4, "peer3", genesis); err != nil {
+		t.Fatalf("Add() Error: %v", err)
+	}
+	if !pool.Contains(sibling.GetHashStr()) || pool.Contains(b2.GetHashStr()) {
+		t.Fatalf("Evicted an orphan of a peer holding fewer")
+	}
+
+	// Senders that cannot be told apart are only held to the overall limits.
+	pool = NewOrphanPool(3, ORPHAN_MAX_BYTES, 1, time.Minute)
+	for _, block := range []*Block{b2, b3, sibling} {
+		if _, err := pool.Add(block, "", genesis); err != nil {
+			t.Fatalf("Add() from an unknown sender returned %v", err)
+		}
+	}
+}
+
+func TestReceiveOrphanBlock(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	node := NewTcpMiner("Pooly", NewRealNet(), NUM_ROUNDS_MINING, genesis, nil, "", config)
+	b1 := minedBlock(t, genesis, config, "miner")
+	b2 := minedBlock(t, b1, config, "miner")
+
+	// b2 waits for its parent, and is connected once b1 arrives.
+	if node.ReceiveBlock(*b2) != nil {
+		t.Fatalf("Connected a block without its parent")
+	}
+	node.mu.Lock()
+	held := node.Orphans.Contains(b2.GetHashStr())
+	node.mu.Unlock()
+	if !held {
+		t.Fatalf("Orphan block was not held")
+	}
+	node.ReceiveBlock(*b1)
+	waitForHeight(t, node, 2)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.Orphans.Len() != 0 || node.LastBlock.GetHashStr() != b2.GetHashStr() {
+		t.Fatalf("Orphan block was not connected")
+	}
+}
+
+// Registered peers on the same host each get their own quota. The claimed
+// port only counts from the host the peer registered from.
+func TestOrphanQuotaPerPeer(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	node := NewTcpMiner("Pooly", NewRealNet(), NUM_ROUNDS_MINING, genesis, nil, "", config)
+	node.Orphans = NewOrphanPool(ORPHAN_MAX_COUNT, ORPHAN_MAX_BYTES, 1, ORPHAN_EXPIRY)
+	node.Net.Register(TcpConnectionInfo{Name: "A", Address: "peerA", Connection: "49001"})
+	node.Net.Register(TcpConnectionInfo{Name: "B", Address: "peerB", Connection: "49002"})
+	node.Net.Register(TcpConnectionInfo{Name: "C", Address: "peerC", Connection: "49001", Host: "10.0.0.7"})
+	blocks := []*Block{genesis}
+	for i := 0; i < 6; i++ {
+		blocks = append(blocks, minedBlock(t, blocks[i], config, "miner"))
+	}
+
+	send := func(block *Block, host string, from string) bool {
+		data, _ := BlockToBytes(block)
+		message, _ := json.Marshal(TcpData{Msg: PROOF_FOUND, Data: data, From: from})
+		node.HandleConnection(message, host)
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return node.Orphans.Contains(block.GetHashStr())
+	}
+	if !send(blocks[2], "127.0.0.1", "49001") || send(blocks[3], "127.0.0.1", "49001") {
+		t.Fatalf("Peer A was not held to its quota")
+	}
+	if !send(blocks[3], "127.0.0.1", "49002") {
+		t.Fatalf("Peer B was charged for peer A's orphan")
+	}
+	// An unregistered port is charged to the host.
+	if !send(blocks[4], "127.0.0.1", "49003") {
+		t.Fatalf("Orphan from an unregistered port was not held")
+	}
+	// Claiming peer A's port from another host does not use peer A's quota,
+	// while peer C's own host does get peer C's.
+	if !send(blocks[5], "10.0.0.5", "49001") || !send(blocks[6], "10.0.0.7", "49001") {
+		t.Fatalf("Orphans from other hosts were not held")
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	expected := map[string]int{"127.0.0.1": 1, "127.0.0.1:49001": 1, "127.0.0.1:49002": 1, "10.0.0.5": 1, "10.0.0.7:49001": 1}
+	if !reflect.DeepEqual(node.Orphans.byPeer, expected) {
+		t.Fatalf("Orphans were charged to %v", node.Orphans.byPeer)
+	}
+}
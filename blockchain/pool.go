@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shares are this many bits easier than the block target by default.
+const POOL_SHARE_SHIFT uint = 8
+
+// Number of most recent shares a found block's reward is split over.
+const POOL_PPLNS_WINDOW int = 1000
+
+// How often the pool checks whether found blocks are confirmed.
+const POOL_PAYOUT_INTERVAL time.Duration = 10 * time.Second
+
+var ErrUnknownJob = errors.New("unknown or stale job")
+var ErrBadShare = errors.New("share does not meet the share target")
+var ErrDuplicateShare = errors.New("duplicate share")
+
+// Work handed to a pool worker. A share is any proof whose header hash is
+// below ShareTarget; a share that is also below BlockTarget finds a block.
+type PoolWork struct {
+	JobId       string
+	Header      []byte
+	ShareTarget string
+	BlockTarget string
+}
+
+type PoolWorkRequest struct {
+	Address string
+}
+
+type ShareRequest struct {
+	JobId string
+	Proof uint32
+}
+
+type ShareReply struct {
+	Block bool
+}
+
+type poolJob struct {
+	address     string
+	header      []byte
+	shareTarget [32]byte
+	blockTarget [32]byte
+	prevHash    string
+	proofs      map[uint32]bool
+}
+
+// A block found by the pool, with the shares it will be paid out over.
+type poolBlock struct {
+	hash   string
+	height uint32
+	shares map[string]uint64
+}
+
+// Mining pool on top of a TcpMiner. Workers mine the node's templates
+// against an easier share target, and block rewards are paid to the last
+// shares (PPLNS) with an ordinary multi-output transaction once the block is
+// confirmed.
+type Pool struct {
+	node       *TcpMiner
+	shareShift uint
+	window     int
+	shares     []string
+	jobs       map[string]*poolJob
+	found      []poolBlock
+	nextJob    uint64
+	mu         sync.Mutex
+}
+
+func NewPool(node *TcpMiner, shareShift uint, window int) *Pool {
+	var p Pool
+	p.node = node
+	p.shareShift = shareShift
+	p.window = window
+	p.jobs = make(map[string]*poolJob)
+	return &p
+}
+
+// Makes the share target shareShift bits easier than the block target,
+// without going past the largest possible target.
+func shareTarget(blockTarget [32]byte, shift uint) [32]byte {
+	target := new(big.Int).SetBytes(blockTarget[:])
+	target.Lsh(target, shift)
+	max := CalculateTarget(0)
+	if target.Cmp(max) > 0 {
+		target = max
+	}
+	var out [32]byte
+	target.FillBytes(out[:])
+	return out
+}
+
+func (p *Pool) GetWork(address string) (*PoolWork, error) {
+	template, err := (*p).node.GetBlockTemplate()
+	if err != nil {
+		return nil, err
+	}
+	var header BlockHeader
+	if err := header.UnmarshalBinary((*template).Header); err != nil {
+		return nil, err
+	}
+
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	// Jobs for an older head can no longer produce a block.
+	prevHash := headerHashString(header.PrevBlockHash)
+	for id, job := range (*p).jobs {
+		if (*job).prevHash != prevHash {
+			delete((*p).jobs, id)
+		}
+	}
+	(*p).nextJob++
+	jobId := fmt.Sprintf("%d", (*p).nextJob)
+	job := poolJob{
+		address:     address,
+		header:      (*template).Header,
+		shareTarget: shareTarget(header.Target, (*p).shareShift),
+		blockTarget: header.Target,
+		prevHash:    prevHash,
+		proofs:      make(map[uint32]bool),
+	}
+	(*p).jobs[jobId] = &job
+	return &PoolWork{
+		JobId:       jobId,
+		Header:      job.header,
+		ShareTarget: hex.EncodeToString(job.shareTarget[:]),
+		BlockTarget: hex.EncodeToString(job.blockTarget[:]),
+	}, nil
+}
+
+// Checks and records a share. Returns true if the share also found a block,
+// which is then submitted to the node.
+func (p *Pool) SubmitShare(jobId string, proof uint32) (bool, error) {
+	(*p).mu.Lock()
+	job, ok := (*p).jobs[jobId]
+	if !ok {
+		(*p).mu.Unlock()
+		return false, ErrUnknownJob
+	}
+	if (*job).proofs[proof] {
+		(*p).mu.Unlock()
+		return false, ErrDuplicateShare
+	}
+	data := append([]byte{}, (*job).header...)
+	binary.BigEndian.PutUint32(data[proofOffset:], proof)
+	hash := sha256.Sum256(data)
+	if bytes.Compare(hash[:], (*job).shareTarget[:]) >= 0 {
+		(*p).mu.Unlock()
+		return false, ErrBadShare
+	}
+	(*job).proofs[proof] = true
+	(*p).shares = append((*p).shares, (*job).address)
+	if len((*p).shares) > (*p).window {
+		(*p).shares = (*p).shares[len((*p).shares)-(*p).window:]
+	}
+	if bytes.Compare(hash[:], (*job).blockTarget[:]) >= 0 {
+		(*p).mu.Unlock()
+		return false, nil
+	}
+	counts := make(map[string]uint64)
+	for _, address := range (*p).shares {
+		counts[address]++
+	}
+	(*p).mu.Unlock()
+
+	// The node lock is taken here, so the pool lock must not be held.
+	if err := (*p).node.SubmitBlock((*job).header, proof); err != nil {
+		return false, err
+	}
+	var header BlockHeader
+	header.UnmarshalBinary(data)
+	(*p).mu.Lock()
+	(*p).found = append((*p).found, poolBlock{hash: hex.EncodeToString(hash[:]), height: header.ChainLength, shares: counts})
+	(*p).mu.Unlock()
+	return true, nil
+}
+
+// Splits reward over the shares in proportion to their counts, rounding
+// down. Any remainder stays with the pool.
+func pplnsPayouts(shares map[string]uint64, reward Amount) []Output {
+	var total uint64 = 0
+	for _, count := range shares {
+		total += count
+	}
+	addresses := make([]string, 0, len(shares))
+	for address := range shares {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	var outputs []Output
+	for _, address := range addresses {
+		hi, lo := bits.Mul64(uint64(reward), shares[address])
+		amount, _ := bits.Div64(hi, lo, total)
+		if amount > 0 {
+			outputs = append(outputs, Output{Address: address, Amount: Amount(amount)})
+		}
+	}
+	return outputs
+}
+
+// Pays out every found block whose reward has been credited in a confirmed
+// block, and forgets blocks that did not make it into the chain.
+func (p *Pool) ProcessPayouts() {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	var waiting []poolBlock
+	for _, found := range (*p).found {
+		// The reward is credited in the block after the one found.
+		if (*p).node.ConfirmedBlockAt(found.height+1) == nil {
+			waiting = append(waiting, found)
+			continue
+		}
+		block := (*p).node.ConfirmedBlockAt(found.height)
+		if block.GetHashStr() != found.hash {
+			fmt.Printf("Pool block %s at height %d was orphaned\n", found.hash, found.height)
+			continue
+		}
+		reward, err := block.TotalRewards()
+		fee := (*p).node.Config.defaultTxFee
+		if err != nil || reward <= fee {
+			continue
+		}
+		outputs := pplnsPayouts(found.shares, reward-fee)
+		if _, err := (*p).node.PostTransaction(outputs, fee); err != nil {
+			// Most likely the reward is still tied up by earlier payouts.
+			fmt.Printf("Pool payout for block %s failed: %v\n", found.hash, err)
+			waiting = append(waiting, found)
+		}
+	}
+	(*p).found = waiting
+}
+
+// The listener returned by Pool.Serve. Closing it also stops the payouts.
+type poolListener struct {
+	net.Listener
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (l *poolListener) Close() error {
+	(*l).stopOnce.Do(func() {
+		close((*l).stop)
+	})
+	return (*l).Listener.Close()
+}
+
+// The address the pool is served on, see TcpMiner.PoolConnection.
+func poolBindAddress(connection string) string {
+	if _, _, err := net.SplitHostPort(connection); err == nil {
+		return connection
+	}
+	return "localhost:" + connection
+}
+
+// Serves the pool to workers over net/rpc and pays out found blocks in the
+// background, until the returned listener is closed.
+func (p *Pool) Serve(address string) (net.Listener, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Pool", &PoolService{pool: p}); err != nil {
+		return nil, err
+	}
+	inner, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &poolListener{Listener: inner, stop: make(chan struct{})}
+	go server.Accept(l)
+	go p.payoutLoop(POOL_PAYOUT_INTERVAL, (*l).stop)
+	return l, nil
+}
+
+func (p *Pool) payoutLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.ProcessPayouts()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type PoolService struct {
+	pool *Pool
+}
+
+func (s *PoolService) GetWork(request *PoolWorkRequest, reply *PoolWork) error {
+	work, err := (*s).pool.GetWork((*request).Address)
+	if err != nil {
+		return err
+	}
+	*reply = *work
+	return nil
+}
+
+func (s *PoolService) SubmitShare(request *ShareRequest, reply *ShareReply) error {
+	found, err := (*s).pool.SubmitShare((*request).JobId, (*request).Proof)
+	(*reply).Block = found
+	return err
+}
+
+// Searches proofs 0 to rounds for shares, passing each one to submit. Run
+// stops every worker at the first proof found, leaving the rest of their
+// ranges unsearched, so each worker runs its own single-worker search and
+// carries on right after its own shares.
+func mineShares(search *ProofSearch, rounds uint32, options MiningOptions, submit func(proof uint32)) {
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	single := options
+	single.Workers = 1
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		lo := uint64(rounds) * uint64(w) / uint64(workers)
+		hi := uint64(rounds) * uint64(w+1) / uint64(workers)
+		wg.Add(1)
+		go func(lo uint64, hi uint64) {
+			defer wg.Done()
+			for lo < hi {
+				result := search.Run(uint32(lo), uint32(hi-lo), single, nil)
+				if !result.Found {
+					return
+				}
+				submit(result.Proof)
+				lo = uint64(result.Proof) + 1
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+}
+
+// Mines shares for a pool, to be paid to payoutAddr. Every share in a batch
+// is submitted before fresh work is fetched.
+func RunPoolWorker(address string, payoutAddr string, rounds uint32, options MiningOptions) error {
+	client, err := rpc.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		var work PoolWork
+		if err := client.Call("Pool.GetWork", &PoolWorkRequest{Address: payoutAddr}, &work); err != nil {
+			return err
+		}
+		var header BlockHeader
+		if err := header.UnmarshalBinary(work.Header); err != nil {
+			return err
+		}
+		search := header.NewProofSearch()
+		target, err := hex.DecodeString(work.ShareTarget)
+		if err != nil || len(target) != 32 {
+			return fmt.Errorf("bad share target %q", work.ShareTarget)
+		}
+		copy((*search).target[:], target)
+
+		mineShares(search, rounds, options, func(proof uint32) {
+			var reply ShareReply
+			if err := client.Call("Pool.SubmitShare", &ShareRequest{JobId: work.JobId, Proof: proof}, &reply); err != nil {
+				fmt.Printf("Share rejected: %v\n", err)
+			} else if reply.Block {
+				fmt.Printf("Found block with proof %d\n", proof)
+			}
+		})
+	}
+}
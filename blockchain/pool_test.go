@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPplnsPayouts(t *testing.T) {
+	outputs := pplnsPayouts(map[string]uint64{"bob": 1, "alice": 3}, 100)
+	if len(outputs) != 2 || outputs[0] != (Output{Address: "alice", Amount: 75}) || outputs[1] != (Output{Address: "bob", Amount: 25}) {
+		t.Fatalf("Unexpected payouts %v", outputs)
+	}
+
+	// Rounding down never pays out more than the reward, and shares too
+	// small to earn anything get no output.
+	outputs = pplnsPayouts(map[string]uint64{"alice": 1, "bob": 1, "carol": 1, "dave": 0}, 100)
+	total, _ := OutputsTotal(outputs, 0)
+	if len(outputs) != 3 || total != 99 {
+		t.Fatalf("Paid %d over %v, expected 99 over three outputs", total, outputs)
+	}
+
+	// Large rewards do not overflow the intermediate product.
+	outputs = pplnsPayouts(map[string]uint64{"alice": 1 << 40, "bob": 1 << 40}, MAX_AMOUNT)
+	if outputs[0].Amount != MAX_AMOUNT/2 || outputs[1].Amount != MAX_AMOUNT/2 {
+		t.Fatalf("Unexpected payouts %v", outputs)
+	}
+}
+
+// Finds the first share for a job at or after start.
+func findShare(t *testing.T, work *PoolWork, start uint32) uint32 {
+	var header BlockHeader
+	if err := header.UnmarshalBinary(work.Header); err != nil {
+		t.Fatalf("Received a bad header: %v", err)
+	}
+	search := header.NewProofSearch()
+	target, _ := hex.DecodeString(work.ShareTarget)
+	copy(search.target[:], target)
+	result := search.Run(start, 1<<24, DefaultMiningOptions(), nil)
+	if !result.Found {
+		t.Fatalf("No share found")
+	}
+	return result.Proof
+}
+
+func TestPoolPayout(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	node := NewTcpMiner("Pooly", NewRealNet(), NUM_ROUNDS_MINING, genesis, nil, "", config)
+	node.StartNewSearch(nil)
+	pool := NewPool(node, 4, POOL_PPLNS_WINDOW)
+
+	if _, err := pool.SubmitShare("missing", 0); !errors.Is(err, ErrUnknownJob) {
+		t.Fatalf("SubmitShare() for an unknown job returned %v", err)
+	}
+	work, err := pool.GetWork("alice")
+	if err != nil {
+		t.Fatalf("GetWork() Error: %v", err)
+	}
+	if work.ShareTarget <= work.BlockTarget {
+		t.Fatalf("Share target %s is not easier than block target %s", work.ShareTarget, work.BlockTarget)
+	}
+	var header BlockHeader
+	header.UnmarshalBinary(work.Header)
+	search := header.NewProofSearch()
+	target, _ := hex.DecodeString(work.ShareTarget)
+	copy(search.target[:], target)
+	badProof := uint32(0)
+	for search.Check(badProof) {
+		badProof++
+	}
+	if _, err := pool.SubmitShare(work.JobId, badProof); !errors.Is(err, ErrBadShare) {
+		t.Fatalf("SubmitShare() with a bad share returned %v", err)
+	}
+	proof := findShare(t, work, 0)
+	found, err := pool.SubmitShare(work.JobId, proof)
+	if err != nil {
+		t.Fatalf("SubmitShare() Error: %v", err)
+	}
+	if _, err := pool.SubmitShare(work.JobId, proof); !errors.Is(err, ErrDuplicateShare) {
+		t.Fatalf("SubmitShare() with a duplicate share returned %v", err)
+	}
+
+	// Alice and bob take turns submitting shares until one finds a block,
+	// unless the first share already did.
+	workers := []string{"alice", "bob"}
+	shares := map[string]uint64{"alice": 1}
+	for i := 0; !found; i++ {
+		address := workers[i%2]
+		work, _ := pool.GetWork(address)
+		found, err = pool.SubmitShare(work.JobId, findShare(t, work, 0))
+		if err != nil {
+			t.Fatalf("SubmitShare() Error: %v", err)
+		}
+		shares[address]++
+	}
+	waitForHeight(t, node, 1)
+
+	// Jobs for the old head are dropped once work for the new one is handed
+	// out.
+	pool.GetWork("alice")
+	if _, err := pool.SubmitShare(work.JobId, findShare(t, work, proof+1)); !errors.Is(err, ErrUnknownJob) {
+		t.Fatalf("SubmitShare() for a stale job returned %v", err)
+	}
+
+	// Nothing is paid until the reward is confirmed.
+	pool.ProcessPayouts()
+	if len(node.PendingOutgoingTransactions) != 0 {
+		t.Fatalf("Paid out an unconfirmed block")
+	}
+	mineTemplates(t, node, CONFIRMED_DEPTH+2)
+
+	pool.ProcessPayouts()
+	if len(node.PendingOutgoingTransactions) != 1 {
+		t.Fatalf("Expected one payout transaction, found %d", len(node.PendingOutgoingTransactions))
+	}
+	for _, tx := range node.PendingOutgoingTransactions {
+		reward := config.SubsidyAt(1) - config.defaultTxFee
+		expected := pplnsPayouts(shares, reward)
+		if len(tx.Info.Outputs) != len(expected) {
+			t.Fatalf("Paid %v, expected %v", tx.Info.Outputs, expected)
+		}
+		for i := range expected {
+			if tx.Info.Outputs[i] != expected[i] {
+				t.Fatalf("Paid %v, expected %v", tx.Info.Outputs, expected)
+			}
+		}
+	}
+
+	// A block is only paid out once.
+	pool.ProcessPayouts()
+	if len(node.PendingOutgoingTransactions) != 1 {
+		t.Fatalf("Paid out the same block twice")
+	}
+}
+
+func TestPoolServeStops(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	node := NewTcpMiner("Pooly", NewRealNet(), NUM_ROUNDS_MINING, genesis, nil, "", config)
+	node.StartNewSearch(nil)
+	pool := NewPool(node, 4, POOL_PPLNS_WINDOW)
+
+	l, err := pool.Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Serve() Error: %v", err)
+	}
+	l.Close()
+	select {
+	case <-l.(*poolListener).stop:
+	default:
+		t.Fatalf("Closing the listener did not stop the payouts")
+	}
+	l.Close()
+
+	// The payout loop returns once it is stopped.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		pool.payoutLoop(time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Payout loop is still running")
+	}
+}
+
+// Every proof in the batch is searched, however the shares fall across the
+// workers.
+func TestMineSharesCoversBatch(t *testing.T) {
+	var header BlockHeader
+	search := header.NewProofSearch()
+	for i := range (*search).target {
+		(*search).target[i] = 0xff
+	}
+	var mu sync.Mutex
+	shares := make(map[uint32]int)
+	mineShares(search, 1000, MiningOptions{Workers: 4, CpuLimit: 100}, func(proof uint32) {
+		mu.Lock()
+		defer mu.Unlock()
+		shares[proof]++
+	})
+	for proof := uint32(0); proof < 1000; proof++ {
+		if shares[proof] != 1 {
+			t.Fatalf("Proof %d was submitted %d times", proof, shares[proof])
+		}
+	}
+}
+
+// A bare pool port is only served on localhost.
+func TestPoolBindAddress(t *testing.T) {
+	if address := poolBindAddress("8000"); address != "localhost:8000" {
+		t.Fatalf("Port 8000 is bound on %s", address)
+	}
+	if address := poolBindAddress("0.0.0.0:8000"); address != "0.0.0.0:8000" {
+		t.Fatalf("0.0.0.0:8000 is bound on %s", address)
+	}
+}
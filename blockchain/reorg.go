@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/chuckpreslar/emission"
+)
+
+// Emitted with a *Reorg whenever a node's head changes. Wallets and indexes
+// can subscribe to it on the node's Emitter. Events arrive one at a time, in
+// the order the head changed.
+const REORG string = "REORG"
+
+// A change of head. Disconnected lists the blocks of the old branch from
+// OldTip down to the fork point, and Connected the blocks of the new branch
+// from just above the fork point up to NewTip. Depth is the number of blocks
+// disconnected, so it is 0 when NewTip simply extends OldTip.
+//
+// The blocks belong to the node, and their state is read through its state
+// store, which only the node's lock protects. Listeners may read their
+// hashes and transactions, but must not call BalanceOf, NonceOf or Accounts
+// on them. Accounts holds the state they need instead: every account that a
+// disconnected or connected block touched, as of NewTip, copied when the
+// head moved. An account that no longer exists has a zero state.
+type Reorg struct {
+	OldTip       *Block
+	NewTip       *Block
+	Depth        int
+	Disconnected []*Block
+	Connected    []*Block
+	Accounts     map[string]AccountState
+}
+
+// Moves state over to newTip, reverting the diffs of the blocks it
+// disconnects and applying those of the blocks it connects.
+func reorganize(state *StateStore, newTip *Block) (*Reorg, error) {
+	oldTip := state.Tip()
+	disconnected, connected, err := state.SetTip(newTip)
+	if err != nil {
+		return nil, err
+	}
+	accounts := make(map[string]AccountState)
+	for _, blocks := range [][]*Block{disconnected, connected} {
+		for _, block := range blocks {
+			for _, change := range (*block).Diff.Changes {
+				address := change.After.Address
+				account, ok := (*state).accounts[address]
+				if !ok {
+					account = AccountState{Address: address}
+				}
+				accounts[address] = account
+			}
+		}
+	}
+	return &Reorg{
+		OldTip:       oldTip,
+		NewTip:       newTip,
+		Depth:        len(disconnected),
+		Disconnected: disconnected,
+		Connected:    connected,
+		Accounts:     accounts,
+	}, nil
+}
+
+// Hands a node's Reorg events to its REORG listeners in order. The node
+// queues them while holding its lock, and one goroutine emits them after,
+// so a listener may call back into the node without deadlocking. The queue
+// is unbounded for the same reason: a full queue would block the node.
+type reorgQueue struct {
+	mu      sync.Mutex
+	pending []*Reorg
+	wake    chan struct{}
+}
+
+func newReorgQueue(emitter *emission.Emitter) *reorgQueue {
+	var q reorgQueue
+	q.wake = make(chan struct{}, 1)
+	go q.run(emitter)
+	return &q
+}
+
+func (q *reorgQueue) push(reorg *Reorg) {
+	(*q).mu.Lock()
+	(*q).pending = append((*q).pending, reorg)
+	(*q).mu.Unlock()
+	select {
+	case (*q).wake <- struct{}{}:
+	default:
+	}
+}
+
+// Emit waits for every listener, so each event is fully delivered before
+// the next one starts.
+func (q *reorgQueue) run(emitter *emission.Emitter) {
+	for range (*q).wake {
+		for {
+			(*q).mu.Lock()
+			if len((*q).pending) == 0 {
+				(*q).mu.Unlock()
+				break
+			}
+			reorg := (*q).pending[0]
+			(*q).pending = (*q).pending[1:]
+			(*q).mu.Unlock()
+			emitter.Emit(REORG, reorg)
+		}
+	}
+}
+
+// Whether one of the connected blocks includes tx.
+func (r *Reorg) connects(tx *Transaction) bool {
+	for _, block := range (*r).Connected {
+		if block.Contains(tx) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chuckpreslar/emission"
+)
+
+func TestMinerReorg(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 1000})
+	minerKey, _, _ := GenerateKeypair()
+	miner := NewMiner("Minnie", NewFakeNet(), NUM_ROUNDS_MINING, genesis, minerKey, config)
+	miner.StartNewSearch(nil)
+
+	events := make(chan *Reorg, 4)
+	miner.Emitter.On(REORG, func(reorg *Reorg) {
+		events <- reorg
+	})
+	nextEvent := func() *Reorg {
+		select {
+		case reorg := <-events:
+			return reorg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No reorg event")
+			return nil
+		}
+	}
+	hashes := func(blocks []*Block) []string {
+		var ids []string
+		for _, block := range blocks {
+			ids = append(ids, block.GetHashStr())
+		}
+		return ids
+	}
+	tx, _ := NewTransaction(address1, 0, pubKey1, nil, config.defaultTxFee, []Output{{Address: "bob", Amount: 10}}, nil)
+	tx.Sign(privKey1)
+	a1 := minedBlock(t, genesis, config, "minerA", tx)
+	b1 := minedBlock(t, genesis, config, "minerB")
+	b2 := minedBlock(t, b1, config, "minerB")
+
+	// Extending the head is a reorg of depth 0.
+	miner.ReceiveBlock(*a1)
+	reorg := nextEvent()
+	if reorg.Depth != 0 || reorg.OldTip != genesis || reorg.NewTip.GetHashStr() != a1.GetHashStr() || len(reorg.Connected) != 1 {
+		t.Fatalf("Unexpected reorg %+v", reorg)
+	}
+	if reorg.Accounts["bob"].Balance != 10 {
+		t.Fatalf("Reorg reports %d for bob, expected 10", reorg.Accounts["bob"].Balance)
+	}
+
+	// A fork with the same work does not move the head.
+	miner.ReceiveBlock(*b1)
+	if miner.LastBlock.GetHashStr() != a1.GetHashStr() {
+		t.Fatalf("Switched to a fork without more work")
+	}
+
+	// Once the fork has more work, a1 is disconnected and its transaction
+	// goes back into the template being mined.
+	miner.ReceiveBlock(*b2)
+	reorg = nextEvent()
+	if reorg.Depth != 1 || reorg.OldTip.GetHashStr() != a1.GetHashStr() || reorg.NewTip.GetHashStr() != b2.GetHashStr() {
+		t.Fatalf("Unexpected reorg from %d to %d, depth %d", reorg.OldTip.ChainLength, reorg.NewTip.ChainLength, reorg.Depth)
+	}
+	disconnected, connected := hashes(reorg.Disconnected), hashes(reorg.Connected)
+	if len(disconnected) != 1 || disconnected[0] != a1.GetHashStr() {
+		t.Fatalf("Disconnected %v, expected a1", disconnected)
+	}
+	if len(connected) != 2 || connected[0] != b1.GetHashStr() || connected[1] != b2.GetHashStr() {
+		t.Fatalf("Connected %v, expected b1 and b2", connected)
+	}
+	// The accounts are copied as of the new tip, so reading them does not
+	// race with the node.
+	if account := reorg.Accounts["bob"]; account.Balance != 0 || reorg.Accounts["minerA"].Balance != 0 {
+		t.Fatalf("Reorg reports %d for bob after a1 was disconnected", account.Balance)
+	}
+	miner.mu.Lock()
+	defer miner.mu.Unlock()
+	if !miner.CurrentBlock.Contains(tx) && !miner.Mempool.Contains(tx) {
+		t.Fatalf("Transaction of the disconnected block was not returned")
+	}
+	if miner.LastBlock.BalanceOf("bob") != 0 || miner.LastBlock.BalanceOf("minerA") != 0 {
+		t.Fatalf("State of the disconnected block is still applied")
+	}
+	if miner.CurrentBlock.BalanceOf("bob") != 10 {
+		t.Fatalf("Template did not apply the returned transaction")
+	}
+}
+
+// Events queued faster than listeners take them still arrive in order.
+func TestReorgQueueOrder(t *testing.T) {
+	emitter := emission.NewEmitter()
+	events := make(chan int, 100)
+	emitter.On(REORG, func(reorg *Reorg) {
+		time.Sleep(time.Millisecond)
+		events <- reorg.Depth
+	})
+	queue := newReorgQueue(emitter)
+	for i := 0; i < 100; i++ {
+		queue.push(&Reorg{Depth: i})
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case depth := <-events:
+			if depth != i {
+				t.Fatalf("Event %d arrived as number %d", depth, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d was not delivered", i)
+		}
+	}
+}
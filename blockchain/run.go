@@ -14,7 +14,7 @@ import (
 	"strings"
 )
 
-func NewMinerSaveJson(fileName string, name string, port string) {
+func NewMinerSaveJson(fileName string, name string, port string, rpcPort string, poolPort string, dataDir string) {
 
 	privKey, _, _ := GenerateKeypair()
 
@@ -22,6 +22,9 @@ func NewMinerSaveJson(fileName string, name string, port string) {
 	jsonData.Name = name
 	jsonData.KeyPair = *privKey
 	jsonData.Connection = port
+	jsonData.RpcConnection = rpcPort
+	jsonData.PoolConnection = poolPort
+	jsonData.DataDir = dataDir
 	jsonBytes, err := json.Marshal(jsonData)
 	if err != nil {
 		fmt.Println("SaveJson() Marshal fail:", err)
@@ -72,9 +75,9 @@ func LoadMinerConfig(fileName string) *SaveJsonType {
 
 }
 
-func LoadStartingBalances(filePath1 string) map[string]uint32 {
+func LoadStartingBalances(filePath1 string) map[string]Amount {
 	file, err := os.Open(filePath1)
-	Balances := make(map[string]uint32)
+	Balances := make(map[string]Amount)
 	if err != nil {
 		fmt.Println("LoadStartingBalances() fails to open file", err)
 		return nil
@@ -88,11 +91,11 @@ func LoadStartingBalances(filePath1 string) map[string]uint32 {
 			return nil
 		}
 
-		num, err := strconv.Atoi(res[1])
+		num, err := strconv.ParseUint(res[1], 10, 64)
 		if err != nil {
-			fmt.Println("LoadStartingBalances() Atoi fails", err)
+			fmt.Println("LoadStartingBalances() ParseUint fails", err)
 		}
-		Balances[res[0]] = uint32(num)
+		Balances[res[0]] = Amount(num)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -101,17 +104,61 @@ func LoadStartingBalances(filePath1 string) map[string]uint32 {
 	return Balances
 }
 
+// The network run from the command line: its difficulty and where its
+// starting balances are read from.
+const NETWORK_LEADING_ZEROES uint32 = 20
+const STARTING_BALANCES_FILE string = "./config/starting_balances.txt"
+
+// Builds the genesis block and config of the network run from the command
+// line. Both -g and -p use it, so the projected supply is that of the chain
+// the node actually runs.
+func LoadNetworkGenesis() (*Block, BlockchainConfig, map[string]Amount, error) {
+	startingBalances := LoadStartingBalances(STARTING_BALANCES_FILE)
+	genesis, config, err := MakeGenesis(NETWORK_LEADING_ZEROES, COINBASE_AMT_ALLOWED, DEFAULT_TX_FEE, CONFIRMED_DEPTH, startingBalances)
+	return genesis, config, startingBalances, err
+}
+
+func ShowProjectedSupply(config BlockchainConfig, startingBalances map[string]Amount, height uint32) {
+	allocations := make([]Amount, 0, len(startingBalances))
+	for _, balance := range startingBalances {
+		allocations = append(allocations, balance)
+	}
+	allocated, err := SumAmounts(allocations...)
+	if err != nil {
+		fmt.Println("ShowProjectedSupply() genesis allocations overflow", err)
+		return
+	}
+	issued := config.IssuedAt(height)
+	supply, err := allocated.CheckedAdd(issued)
+	if err != nil {
+		fmt.Println("ShowProjectedSupply() supply overflow", err)
+		return
+	}
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Coinbase reward: %d\n", config.SubsidyAt(height))
+	fmt.Printf("Genesis allocations: %d\n", allocated)
+	fmt.Printf("Coinbase issued: %d\n", issued)
+	fmt.Printf("Projected supply: %d\n", supply)
+}
+
 func readUserInput(m *TcpMiner) {
 	for {
 		reader := bufio.NewReader(os.Stdin)
 		var menu string = ""
-		menu += fmt.Sprintf("Funds: %d\n", m.AvailableGold())
+		funds, err := m.AvailableGold()
+		if err != nil {
+			menu += fmt.Sprintf("Funds: unavailable (%v)\n", err)
+		} else {
+			menu += fmt.Sprintf("Funds: %d\n", funds)
+		}
 		menu += fmt.Sprintf("Address: %s\n", (*m).Address)
+		menu += fmt.Sprintf("Hashrate: %.0f hashes/s\n", m.Hashrate())
 		menu += fmt.Sprintf("Pending transactions: %s\n", m.ShowPendingOut())
 		menu += "What would you like to do?\n"
 		menu += "*(c)onnect to miner?\n"
 		menu += "*(t)ransfer funds?\n"
 		menu += "*(r)esend pending transactions?\n"
+		menu += "*(i)ncrease the fee of a pending transaction?\n"
 		menu += "*show (b)alances?\n"
 		menu += "*show blocks for (d)ebugging and exit?\n"
 		menu += "*(s)ave your state?\n"
@@ -138,15 +185,17 @@ func readUserInput(m *TcpMiner) {
 			fmt.Print("  amount: ")
 			amt, _ := reader.ReadString('\n')
 			amt = strings.TrimSuffix(amt, "\n")
-			amtInt, err := strconv.Atoi(amt)
+			amtInt, err := strconv.ParseUint(amt, 10, 64)
 			if err != nil {
 				fmt.Println("Wrong input")
-			} else if amtInt <= 0 {
+			} else if amtInt == 0 {
 				fmt.Println("Wrong input")
 			} else {
-				amtUint := uint32(amtInt)
-				if amtUint > m.AvailableGold() {
-					fmt.Printf("***Insufficient gold.  You only have %d\n", m.AvailableGold())
+				amtUint := Amount(amtInt)
+				if available, err := m.AvailableGold(); err != nil {
+					fmt.Println("***Funds unavailable:", err)
+				} else if amtUint > available {
+					fmt.Printf("***Insufficient gold.  You only have %d\n", available)
 				} else {
 					fmt.Print("  address: ")
 					addr, _ := reader.ReadString('\n')
@@ -156,11 +205,28 @@ func readUserInput(m *TcpMiner) {
 					output1.Address = addr
 					output1.Amount = amtUint
 					outputs = append(outputs, output1)
-					m.PostTransaction(outputs, m.Config.defaultTxFee)
+					if _, err := m.PostTransaction(outputs, m.Config.defaultTxFee); err != nil {
+						fmt.Println("***Transaction rejected:", err)
+					}
 				}
 			}
 		case "r":
 			m.ResendPendingTransactions()
+		case "i":
+			fmt.Print("  transaction id: ")
+			txId, _ := reader.ReadString('\n')
+			txId = strings.TrimSuffix(txId, "\n")
+			fmt.Print("  new fee: ")
+			fee, _ := reader.ReadString('\n')
+			fee = strings.TrimSuffix(fee, "\n")
+			feeInt, err := strconv.ParseUint(fee, 10, 64)
+			if err != nil {
+				fmt.Println("Wrong input")
+			} else if tx, err := m.BumpFee(txId, Amount(feeInt)); err != nil {
+				fmt.Println("***Fee bump rejected:", err)
+			} else {
+				fmt.Printf("Replaced with transaction %s\n", tx.Id())
+			}
 		case "s":
 			fmt.Print("  file name: ")
 			savePath, _ := reader.ReadString('\n')
@@ -188,13 +254,43 @@ func readUserInput(m *TcpMiner) {
 	}
 }
 
+// Reads the optional worker count and CPU limit starting at arguments[first].
+func parseMiningArguments(arguments []string, first int) (int, int, error) {
+	workers, cpuLimit := 1, 100
+	var err error
+	if len(arguments) > first {
+		if workers, err = strconv.Atoi(arguments[first]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(arguments) > first+1 {
+		if cpuLimit, err = strconv.Atoi(arguments[first+1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return workers, cpuLimit, nil
+}
+
 func main() {
 	arguments := os.Args
-	if len(arguments) != 3 {
+	minArguments, maxArguments := 3, 3
+	if len(arguments) > 1 && (arguments[1] == "-g" || arguments[1] == "-m") {
+		maxArguments = 5
+	} else if len(arguments) > 1 && arguments[1] == "-w" {
+		minArguments, maxArguments = 4, 6
+	}
+	if len(arguments) < minArguments || len(arguments) > maxArguments {
 		fmt.Println("Instruction: ./app [-option] <filepath>")
+		fmt.Println("         or: ./app -p <height>")
 		fmt.Println("option:")
 		fmt.Println("    -c : create a new miner account. <filepath> should be the filepath to save miner config")
 		fmt.Println("    -g : load miner config file. <filepath> should be the filepath to load miner config file")
+		fmt.Println("         optionally followed by the number of mining workers and a CPU limit in percent")
+		fmt.Println("    -m : mine for a local node. <filepath> should be the node's RPC port")
+		fmt.Println("         optionally followed by the number of mining workers and a CPU limit in percent")
+		fmt.Println("    -w : mine for a pool. <filepath> should be the pool's host:port, followed by your payout address")
+		fmt.Println("         and optionally the number of mining workers and a CPU limit in percent")
+		fmt.Println("    -p : print the projected supply. <height> is the block height to project to")
 		return
 	}
 
@@ -209,7 +305,16 @@ func main() {
 		fmt.Print("Please enter your port: ")
 		port, _ := reader.ReadString('\n')
 		port = strings.TrimSuffix(port, "\n")
-		NewMinerSaveJson(configfilepath, name, port)
+		fmt.Print("Please enter your RPC port for external miners (blank for none): ")
+		rpcPort, _ := reader.ReadString('\n')
+		rpcPort = strings.TrimSuffix(rpcPort, "\n")
+		fmt.Print("Please enter your pool port for workers, or host:port to accept remote workers (blank for none): ")
+		poolPort, _ := reader.ReadString('\n')
+		poolPort = strings.TrimSuffix(poolPort, "\n")
+		fmt.Print("Please enter a directory to save blocks in (blank for none): ")
+		dataDir, _ := reader.ReadString('\n')
+		dataDir = strings.TrimSuffix(dataDir, "\n")
+		NewMinerSaveJson(configfilepath, name, port, rpcPort, poolPort, dataDir)
 		fmt.Print("End program.\n")
 	} else if option == "-g" {
 		minerConfig := LoadMinerConfig(configfilepath)
@@ -218,18 +323,71 @@ func main() {
 			return
 		}
 		fmt.Print("Load successful.\n")
-		filepath2, err := filepath.Abs("./config/starting_balances.txt")
+		filepath2, err := filepath.Abs(STARTING_BALANCES_FILE)
 		if err == nil {
 			fmt.Println("Absolute:", filepath2)
 		}
-		startingBalances := LoadStartingBalances(filepath2)
-		//fmt.Printf("starting balances:\n%v\n", *startingBalances)
-		genesis, config, _ := MakeGenesis(20, COINBASE_AMT_ALLOWED, DEFAULT_TX_FEE, CONFIRMED_DEPTH, startingBalances)
+		genesis, config, _, err := LoadNetworkGenesis()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 		net := NewRealNet()
 		miner1 := NewTcpMiner(minerConfig.Name, net, NUM_ROUNDS_MINING, genesis, &minerConfig.KeyPair, minerConfig.Connection, config)
+		workers, cpuLimit, err := parseMiningArguments(arguments, 3)
+		if err != nil {
+			fmt.Println("Wrong input")
+			return
+		}
+		miner1.SetMiningOptions(workers, cpuLimit)
+		miner1.RpcConnection = minerConfig.RpcConnection
+		miner1.PoolConnection = minerConfig.PoolConnection
+		if minerConfig.DataDir != "" {
+			store, err := OpenBlockStore(minerConfig.DataDir, SYNC_BATCHED)
+			if err != nil {
+				fmt.Println("Failed to open the block store:", err)
+				return
+			}
+			defer store.Close()
+			if err := miner1.LoadBlockStore(store); err != nil {
+				fmt.Println("Failed to load the block store:", err)
+				return
+			}
+		}
 		miner1.Initialize(minerConfig.KnownTcpConnections)
 		readUserInput(miner1)
 		fmt.Print("End program.\n")
+	} else if option == "-m" {
+		workers, cpuLimit, err := parseMiningArguments(arguments, 3)
+		if err != nil {
+			fmt.Println("Wrong input")
+			return
+		}
+		err = RunExternalMiner("localhost:"+configfilepath, EXTERNAL_MINING_ROUNDS, NewMiningOptions(workers, cpuLimit))
+		fmt.Println(err)
+		fmt.Print("End program.\n")
+	} else if option == "-w" {
+		workers, cpuLimit, err := parseMiningArguments(arguments, 4)
+		if err != nil {
+			fmt.Println("Wrong input")
+			return
+		}
+		err = RunPoolWorker(configfilepath, arguments[3], EXTERNAL_MINING_ROUNDS, NewMiningOptions(workers, cpuLimit))
+		fmt.Println(err)
+		fmt.Print("End program.\n")
+	} else if option == "-p" {
+		heightArgument := arguments[2]
+		height, err := strconv.ParseUint(heightArgument, 10, 32)
+		if err != nil {
+			fmt.Println("Invalid height:", heightArgument)
+			return
+		}
+		_, config, startingBalances, err := LoadNetworkGenesis()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		ShowProjectedSupply(config, startingBalances, uint32(height))
 	} else {
 		fmt.Print("Invalid option\n")
 		fmt.Print("End program.\n")
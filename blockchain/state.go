@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// The state of a single account, as committed to by a block's StateRoot.
+type AccountState struct {
+	Address string
+	Balance Amount
+	Nonce   uint32
+}
+
+// A proof of an account's balance and nonce as of the block with a given
+// hash. Like TxProof it carries the serialized header.
+type AccountProof struct {
+	Account AccountState
+	Branch  []MerkleStep
+	Header  []byte
+}
+
+// Leaf encoding: length-prefixed address, then balance and nonce, all
+// big-endian, so the leaf cannot be read back in more than one way.
+func (account *AccountState) leafData() []byte {
+	addressLen := len((*account).Address)
+	data := make([]byte, 16+addressLen)
+	binary.BigEndian.PutUint32(data[0:4], uint32(addressLen))
+	copy(data[4:], (*account).Address)
+	binary.BigEndian.PutUint64(data[4+addressLen:], uint64((*account).Balance))
+	binary.BigEndian.PutUint32(data[12+addressLen:], (*account).Nonce)
+	return data
+}
+
+// Collects the diffs, newest first, back to a block whose state is already in
+// a store, and returns that block as well, or nil if there is none.
+func (block *Block) pendingDiffs() ([]*StateDiff, *Block) {
+	var diffs []*StateDiff
+	b := block
+	for b != nil && (*b).store == nil {
+		diffs = append(diffs, &(*b).Diff)
+		b = (*b).parent
+	}
+	return diffs, b
+}
+
+// Lists every account with a balance or nonce, sorted by address so that all
+// nodes build the same state tree.
+func (block *Block) Accounts() []AccountState {
+	diffs, b := block.pendingDiffs()
+	state := make(map[string]AccountState)
+	if b != nil {
+		(*b).store.copyAt(b, state)
+	}
+	for i := len(diffs) - 1; i >= 0; i-- {
+		for _, change := range diffs[i].Changes {
+			state[change.After.Address] = change.After
+		}
+	}
+
+	accounts := make([]AccountState, 0, len(state))
+	for _, account := range state {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Address < accounts[j].Address
+	})
+	return accounts
+}
+
+func stateLeaves(accounts []AccountState) [][]byte {
+	leaves := make([][]byte, len(accounts))
+	for i := range accounts {
+		leaves[i] = accounts[i].leafData()
+	}
+	return leaves
+}
+
+// Computes the Merkle root over the block's balances and nonces. Blocks at
+// or just above the tip of a state store use its tree, so that only the
+// accounts they change are hashed.
+func (block *Block) ComputeStateRoot() string {
+	diffs, b := block.pendingDiffs()
+	if b != nil && (*b).store.tip == b {
+		return hex.EncodeToString((*b).store.rootAbove(diffs))
+	}
+	return hex.EncodeToString(MerkleRoot(stateLeaves(block.Accounts())))
+}
+
+func (block *Block) ProveAccount(address string) (*AccountProof, error) {
+	accounts := block.Accounts()
+	index := sort.Search(len(accounts), func(i int) bool {
+		return accounts[i].Address >= address
+	})
+	if index == len(accounts) || accounts[index].Address != address {
+		return nil, fmt.Errorf("account %s has no state in the block", address)
+	}
+	header, err := block.hashData()
+	if err != nil {
+		return nil, err
+	}
+	return &AccountProof{Account: accounts[index], Branch: MerkleBranch(stateLeaves(accounts), index), Header: header}, nil
+}
+
+// Checks that the proof connects its account state to the block hash.
+func VerifyAccountProof(headerHash string, proof *AccountProof) bool {
+	header, ok := decodeProofHeader(headerHash, (*proof).Header)
+	if !ok {
+		return false
+	}
+	return VerifyMerkleBranch((*proof).Account.leafData(), (*proof).Branch, (*header).StateRoot[:])
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProveAccount(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 1000, "address3": 30})
+
+	block := NewBlock(address2, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	tx, _ := NewTransaction(address1, 0, pubKey1, nil, config.defaultTxFee, []Output{{Address: address2, Amount: 10}}, nil)
+	tx.Sign(privKey1)
+	block.AddTransaction(tx)
+	blockHash := block.GetHashStr()
+
+	proof, err := block.ProveAccount(address1)
+	if err != nil {
+		t.Fatalf("ProveAccount() Error: %v", err)
+	}
+	if proof.Account.Balance != 989 || proof.Account.Nonce != 1 {
+		t.Fatalf("Unexpected account state %+v", proof.Account)
+	}
+	if !VerifyAccountProof(blockHash, proof) {
+		t.Fatalf("Account proof does not verify")
+	}
+
+	// A proof for a different balance, or against another block, fails.
+	proof.Account.Balance = 1000
+	if VerifyAccountProof(blockHash, proof) {
+		t.Fatalf("Account proof verifies a forged balance")
+	}
+	proof, _ = block.ProveAccount(address2)
+	if !VerifyAccountProof(blockHash, proof) || VerifyAccountProof(genesis.GetHashStr(), proof) {
+		t.Fatalf("Account proof is not bound to its block")
+	}
+
+	// The state root is derived from the state, whatever order it is stored in.
+	root := block.StateRoot
+	changes := block.Diff.Changes
+	changes[0], changes[1] = changes[1], changes[0]
+	if block.ComputeStateRoot() != root {
+		t.Fatalf("State root depends on the order of the balances")
+	}
+	changes[0].After.Balance++
+	if block.ComputeStateRoot() == root {
+		t.Fatalf("State root did not change with the balances")
+	}
+}
+
+// The roots are recomputed lazily, but a block is never hashed with roots
+// that predate its last transaction.
+func TestRootsFollowTransactions(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{address1: 1000})
+
+	block := NewBlock(address1, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	emptyHash := block.GetHashStr()
+	tx, _ := NewTransaction(address1, 0, pubKey1, nil, config.defaultTxFee, []Output{{Address: "bob", Amount: 10}}, nil)
+	tx.Sign(privKey1)
+	block.AddTransaction(tx)
+
+	if block.GetHashStr() == emptyHash {
+		t.Fatalf("Block hash did not change with its transactions")
+	}
+	if block.TxRoot != block.ComputeTxRoot() || block.StateRoot != block.ComputeStateRoot() {
+		t.Fatalf("Block was hashed with stale roots")
+	}
+}
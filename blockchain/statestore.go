@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+)
+
+var ErrNoForkPoint = errors.New("block does not share a chain with the state store")
+
+// One account's change within a block. Before is the undo data: the state the
+// account had in the parent block, if it existed there at all.
+type AccountChange struct {
+	After   AccountState
+	Before  AccountState
+	Existed bool
+}
+
+// The account changes a block makes on top of its parent, in the order the
+// accounts were first touched. The genesis block has no parent, so its diff
+// is its whole state.
+type StateDiff struct {
+	Changes []AccountChange
+	index   map[string]int
+}
+
+func (d *StateDiff) lookup(address string) (*AccountChange, bool) {
+	if (*d).index == nil {
+		if len((*d).Changes) == 0 {
+			return nil, false
+		}
+		// Diffs decoded from JSON arrive without their index.
+		(*d).index = make(map[string]int, len((*d).Changes))
+		for i, change := range (*d).Changes {
+			(*d).index[change.After.Address] = i
+		}
+	}
+	i, ok := (*d).index[address]
+	if !ok {
+		return nil, false
+	}
+	return &(*d).Changes[i], true
+}
+
+// Records the account's new state. The undo data is only taken the first
+// time the account is touched.
+func (d *StateDiff) set(after AccountState, before AccountState, existed bool) {
+	if change, ok := d.lookup(after.Address); ok {
+		(*change).After = after
+		return
+	}
+	if (*d).index == nil {
+		(*d).index = make(map[string]int)
+	}
+	(*d).index[after.Address] = len((*d).Changes)
+	(*d).Changes = append((*d).Changes, AccountChange{After: after, Before: before, Existed: existed})
+}
+
+func (d *StateDiff) clone() StateDiff {
+	var clone StateDiff
+	clone.Changes = append([]AccountChange{}, (*d).Changes...)
+	if len(clone.Changes) > 0 {
+		clone.index = make(map[string]int, len(clone.Changes))
+		for i, change := range clone.Changes {
+			clone.index[change.After.Address] = i
+		}
+	}
+	return clone
+}
+
+// The account state as of one block, the tip, keyed by address. Moving the
+// tip reverts the diffs of the blocks it leaves and applies the diffs of the
+// blocks it moves to, so no block needs a copy of every account.
+//
+// Blocks whose diffs have been applied point back at the store, which lets
+// them look accounts up here rather than walking their ancestors' diffs.
+//
+// The store also keeps the state tree of the tip, so the state root of the
+// tip, or of a block being built on it, does not hash every account again.
+type StateStore struct {
+	accounts map[string]AccountState
+	tree     *stateTree
+	tip      *Block
+}
+
+// Makes a store whose tip is root, usually the genesis block.
+func NewStateStore(root *Block) *StateStore {
+	var s StateStore
+	s.accounts = make(map[string]AccountState)
+	accounts := root.Accounts()
+	for _, account := range accounts {
+		s.accounts[account.Address] = account
+	}
+	s.tree = newStateTree(accounts)
+	s.tip = root
+	return &s
+}
+
+func (s *StateStore) Tip() *Block {
+	return (*s).tip
+}
+
+// The number of accounts as of the tip.
+func (s *StateStore) Len() int {
+	return len((*s).accounts)
+}
+
+// The most recent block that both a and b descend from, or nil if they are
+// on unrelated chains.
+func forkPoint(a *Block, b *Block) *Block {
+	for a != b {
+		if a == nil || b == nil {
+			return nil
+		}
+		if (*a).ChainLength > (*b).ChainLength {
+			a = (*a).parent
+		} else if (*b).ChainLength > (*a).ChainLength {
+			b = (*b).parent
+		} else {
+			a, b = (*a).parent, (*b).parent
+		}
+	}
+	return a
+}
+
+// Moves the tip to block. Returns the blocks whose diffs were reverted,
+// starting from the old tip, and the blocks whose diffs were applied,
+// ending with the new one.
+func (s *StateStore) SetTip(block *Block) ([]*Block, []*Block, error) {
+	fork := forkPoint((*s).tip, block)
+	if fork == nil {
+		return nil, nil, ErrNoForkPoint
+	}
+	var reverted []*Block
+	for b := (*s).tip; b != fork; b = (*b).parent {
+		s.revert(b)
+		reverted = append(reverted, b)
+	}
+	var applied []*Block
+	for b := block; b != fork; b = (*b).parent {
+		applied = append(applied, b)
+	}
+	for i, j := 0, len(applied)-1; i < j; i, j = i+1, j-1 {
+		applied[i], applied[j] = applied[j], applied[i]
+	}
+	for _, b := range applied {
+		s.apply(b)
+	}
+	(*s).tip = block
+	return reverted, applied, nil
+}
+
+func (s *StateStore) apply(block *Block) {
+	for _, change := range (*block).Diff.Changes {
+		(*s).accounts[change.After.Address] = change.After
+		(*s).tree.set(change.After)
+	}
+	(*block).store = s
+}
+
+func (s *StateStore) revert(block *Block) {
+	changes := (*block).Diff.Changes
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].Existed {
+			(*s).accounts[changes[i].After.Address] = changes[i].Before
+			(*s).tree.set(changes[i].Before)
+		} else {
+			delete((*s).accounts, changes[i].After.Address)
+			(*s).tree.remove(changes[i].After.Address)
+		}
+	}
+	(*block).store = nil
+}
+
+// Looks up an account as of block, which must be the tip or one of its
+// ancestors. The undo data of the blocks above it is used on the way down.
+func (s *StateStore) accountAt(block *Block, address string) (AccountState, bool) {
+	account, ok := (*s).accounts[address]
+	for b := (*s).tip; b != block; b = (*b).parent {
+		if change, touched := (*b).Diff.lookup(address); touched {
+			account, ok = (*change).Before, (*change).Existed
+		}
+	}
+	if !ok {
+		return AccountState{Address: address}, false
+	}
+	return account, true
+}
+
+// Copies every account as of block, which must be the tip or one of its
+// ancestors, into accounts.
+func (s *StateStore) copyAt(block *Block, accounts map[string]AccountState) {
+	for address, account := range (*s).accounts {
+		accounts[address] = account
+	}
+	for b := (*s).tip; b != block; b = (*b).parent {
+		for _, change := range (*b).Diff.Changes {
+			if change.Existed {
+				accounts[change.After.Address] = change.Before
+			} else {
+				delete(accounts, change.After.Address)
+			}
+		}
+	}
+}
+
+// The state root of the tip with diffs, newest first, applied on top of it.
+func (s *StateStore) rootAbove(diffs []*StateDiff) []byte {
+	accounts := make(map[string]AccountState)
+	for i := len(diffs) - 1; i >= 0; i-- {
+		for _, change := range diffs[i].Changes {
+			accounts[change.After.Address] = change.After
+		}
+	}
+	return (*s).tree.rootWith(accounts)
+}
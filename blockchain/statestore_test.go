@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStateStoreReorg(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{"alice": 1000, "bob": 500})
+	extend := func(prevBlock *Block, winner string) *Block {
+		return NewBlock(winner, prevBlock, config.NextTarget(prevBlock), config.coinbaseAmount)
+	}
+
+	// a1 <- a2 <- a3 and a fork a1 <- b2 <- b3 <- b4.
+	a1 := extend(genesis, "minerA")
+	a2 := extend(a1, "minerA")
+	a2.setBalance("carol", 5)
+	a3 := extend(a2, "minerA")
+	b2 := extend(a1, "minerB")
+	b2.setBalance("alice", 1)
+	b3 := extend(b2, "minerB")
+	b4 := extend(b3, "minerB")
+	blocks := []*Block{genesis, a1, a2, a3, b2, b3, b4}
+
+	// The state of every block, read through its ancestors' diffs alone.
+	expected := make([][]AccountState, len(blocks))
+	for i, block := range blocks {
+		expected[i] = block.Accounts()
+	}
+	check := func(tip *Block) {
+		for i, block := range blocks {
+			if !reflect.DeepEqual(block.Accounts(), expected[i]) {
+				t.Fatalf("With the tip at %d, block %d has state %v, expected %v", tip.ChainLength, i, block.Accounts(), expected[i])
+			}
+			if block.ComputeStateRoot() != hex.EncodeToString(MerkleRoot(stateLeaves(expected[i]))) {
+				t.Fatalf("With the tip at %d, block %d has the wrong state root", tip.ChainLength, i)
+			}
+			for _, account := range expected[i] {
+				if block.BalanceOf(account.Address) != account.Balance || block.NonceOf(account.Address) != account.Nonce {
+					t.Fatalf("With the tip at %d, block %d has the wrong state for %s", tip.ChainLength, i, account.Address)
+				}
+			}
+		}
+	}
+
+	store := NewStateStore(genesis)
+	reverted, applied, err := store.SetTip(a3)
+	if err != nil || len(reverted) != 0 || !reflect.DeepEqual(applied, []*Block{a1, a2, a3}) {
+		t.Fatalf("SetTip(a3) reverted %d and applied %d blocks: %v", len(reverted), len(applied), err)
+	}
+	check(a3)
+	if store.Len() != 4 {
+		t.Fatalf("Store holds %d accounts, expected 4", store.Len())
+	}
+
+	// Switching to the fork undoes a3 and a2, which also removes carol.
+	reverted, applied, err = store.SetTip(b4)
+	if err != nil || !reflect.DeepEqual(reverted, []*Block{a3, a2}) || !reflect.DeepEqual(applied, []*Block{b2, b3, b4}) {
+		t.Fatalf("SetTip(b4) reverted %d and applied %d blocks: %v", len(reverted), len(applied), err)
+	}
+	check(b4)
+	if store.Len() != 4 || b4.BalanceOf("carol") != 0 || b4.BalanceOf("alice") != 1 {
+		t.Fatalf("Fork state was not applied")
+	}
+
+	if _, _, err := store.SetTip(genesis); err != nil || store.Len() != 2 {
+		t.Fatalf("SetTip(genesis) left %d accounts: %v", store.Len(), err)
+	}
+	check(genesis)
+
+	other, _, _ := MakeGenesisDefault(map[string]Amount{"dave": 1})
+	if _, _, err := store.SetTip(extend(other, "minerC")); !errors.Is(err, ErrNoForkPoint) {
+		t.Fatalf("SetTip() on an unrelated chain returned %v", err)
+	}
+}
+
+// The incremental tree must always agree with hashing every account afresh.
+func TestStateTreeRoot(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	state := make(map[string]AccountState)
+	tree := newStateTree(nil)
+	expectedRoot := func(state map[string]AccountState) []byte {
+		accounts := make([]AccountState, 0, len(state))
+		for _, account := range state {
+			accounts = append(accounts, account)
+		}
+		sort.Slice(accounts, func(i, j int) bool {
+			return accounts[i].Address < accounts[j].Address
+		})
+		return MerkleRoot(stateLeaves(accounts))
+	}
+	for round := 0; round < 200; round++ {
+		for i := random.Intn(5); i >= 0; i-- {
+			address := fmt.Sprintf("account%02d", random.Intn(40))
+			if random.Intn(4) == 0 {
+				delete(state, address)
+				tree.remove(address)
+			} else {
+				account := AccountState{Address: address, Balance: Amount(random.Intn(1000)), Nonce: uint32(round)}
+				state[address] = account
+				tree.set(account)
+			}
+		}
+		if !bytes.Equal(tree.root(), expectedRoot(state)) {
+			t.Fatalf("Round %d: tree root does not match %d accounts", round, len(state))
+		}
+
+		// A block on top sees its own changes, without changing the tree.
+		overlay := make(map[string]AccountState)
+		for i := random.Intn(3); i >= 0; i-- {
+			address := fmt.Sprintf("account%02d", random.Intn(45))
+			overlay[address] = AccountState{Address: address, Balance: Amount(random.Intn(1000))}
+		}
+		above := make(map[string]AccountState)
+		for address, account := range state {
+			above[address] = account
+		}
+		for address, account := range overlay {
+			above[address] = account
+		}
+		if !bytes.Equal(tree.rootWith(overlay), expectedRoot(above)) {
+			t.Fatalf("Round %d: root with %d changes on top does not match", round, len(overlay))
+		}
+		if !bytes.Equal(tree.root(), expectedRoot(state)) {
+			t.Fatalf("Round %d: root with changes on top changed the tree", round)
+		}
+	}
+}
+
+// A chain of 1000 blocks over 10000 accounts, each block moving gold between
+// a few of them. The blocks are built directly, without their roots, so that
+// only the state is measured.
+func benchmarkStateChain(b *testing.B) (*Block, []*Block) {
+	b.Helper()
+	const accounts = 10000
+	const blocks = 1000
+	const changesPerBlock = 10
+
+	balances := make(map[string]Amount, accounts)
+	for i := 0; i < accounts; i++ {
+		balances[fmt.Sprintf("account%05d", i)] = 1000000
+	}
+	genesis, _, _ := MakeGenesisDefault(balances)
+
+	random := rand.New(rand.NewSource(1))
+	store := NewStateStore(genesis)
+	chain := make([]*Block, 0, blocks)
+	prevBlock := genesis
+	for i := 0; i < blocks; i++ {
+		block := &Block{ChainLength: prevBlock.ChainLength + 1, parent: prevBlock}
+		for j := 0; j < changesPerBlock; j++ {
+			address := fmt.Sprintf("account%05d", random.Intn(accounts))
+			block.setBalance(address, block.BalanceOf(address)+Amount(j))
+		}
+		store.SetTip(block)
+		chain = append(chain, block)
+		prevBlock = block
+	}
+	return genesis, chain
+}
+
+func BenchmarkStateStoreConnect(b *testing.B) {
+	genesis, chain := benchmarkStateChain(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store := NewStateStore(genesis)
+		store.SetTip(chain[len(chain)-1])
+	}
+}
+
+// Switches back and forth between two branches forking 10 blocks below the
+// tip.
+func BenchmarkStateStoreReorg(b *testing.B) {
+	genesis, chain := benchmarkStateChain(b)
+	fork := chain[len(chain)-11]
+	tip := fork
+	for i := 0; i < 10; i++ {
+		block := &Block{ChainLength: tip.ChainLength + 1, parent: tip}
+		block.setBalance("account00000", block.BalanceOf("account00000")+1)
+		tip = block
+	}
+	store := NewStateStore(genesis)
+	store.SetTip(chain[len(chain)-1])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%2 == 0 {
+			store.SetTip(tip)
+		} else {
+			store.SetTip(chain[len(chain)-1])
+		}
+	}
+}
+
+func BenchmarkBalanceOf(b *testing.B) {
+	_, chain := benchmarkStateChain(b)
+	head := chain[len(chain)-1]
+	template := &Block{ChainLength: head.ChainLength + 1, parent: head}
+	addresses := make([]string, 10000)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("account%05d", i)
+	}
+	for name, block := range map[string]*Block{
+		"head":      head,
+		"confirmed": chain[len(chain)-1-int(CONFIRMED_DEPTH)],
+		"template":  template,
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				block.BalanceOf(addresses[i%len(addresses)])
+			}
+		})
+	}
+}
+
+// Connects the chain again with the state root of every block computed just
+// before it is applied, as a node does when it validates the blocks it
+// receives.
+func BenchmarkStateRootConnect(b *testing.B) {
+	genesis, chain := benchmarkStateChain(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, block := range chain {
+			(*block).store = nil
+		}
+		store := NewStateStore(genesis)
+		for _, block := range chain {
+			block.ComputeStateRoot()
+			store.SetTip(block)
+		}
+	}
+}
+
+// Replays a block of ten transfers on top of the head, roots included.
+func BenchmarkRerun(b *testing.B) {
+	_, chain := benchmarkStateChain(b)
+	head := chain[len(chain)-1]
+	privKey, pubKey, _ := GenerateKeypair()
+	address := GenerateAddress(pubKey)
+	funded := &Block{ChainLength: head.ChainLength + 1, parent: head, Timestamp: head.Timestamp}
+	funded.setBalance(address, 1000000)
+	(*head).store.SetTip(funded)
+
+	block := NewBlock(address, funded, CalculateTarget(0), 0)
+	for i := 0; i < 10; i++ {
+		outputs := []Output{{Address: fmt.Sprintf("account%05d", i*1000), Amount: 10}}
+		tx, _ := NewTransaction(address, uint32(i), pubKey, nil, 1, outputs, nil)
+		tx.Sign(privKey)
+		if !block.AddTransaction(tx) {
+			b.Fatalf("Transaction %d was not added", i)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !block.Rerun(funded) {
+			b.Fatalf("Rerun() failed")
+		}
+	}
+}
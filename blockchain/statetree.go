@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sort"
+)
+
+// The Merkle tree over a state store's accounts, sorted by address, with
+// every level kept between roots. It has the same root as MerkleRoot over
+// stateLeaves, but only rehashes the parts that changed since the last one.
+type stateTree struct {
+	addresses []string
+	// levels[0] holds the leaf hashes, and the last level the root.
+	levels [][][]byte
+	// Leaves from moved onwards were inserted, removed or shifted, so every
+	// node above them is rebuilt. Leaves in changed were updated in place,
+	// so only their paths are.
+	moved   int
+	changed map[int]bool
+}
+
+// Builds the tree over accounts, which must be sorted by address.
+func newStateTree(accounts []AccountState) *stateTree {
+	var t stateTree
+	t.addresses = make([]string, len(accounts))
+	leaves := make([][]byte, len(accounts))
+	for i := range accounts {
+		t.addresses[i] = accounts[i].Address
+		leaves[i] = merkleLeaf(accounts[i].leafData())
+	}
+	t.levels = [][][]byte{leaves}
+	t.changed = make(map[int]bool)
+	return &t
+}
+
+func (t *stateTree) find(address string) (int, bool) {
+	i := sort.SearchStrings((*t).addresses, address)
+	return i, i < len((*t).addresses) && (*t).addresses[i] == address
+}
+
+func (t *stateTree) set(account AccountState) {
+	leaf := merkleLeaf(account.leafData())
+	i, ok := t.find(account.Address)
+	if ok {
+		(*t).levels[0][i] = leaf
+		(*t).changed[i] = true
+		return
+	}
+	(*t).addresses = append((*t).addresses, "")
+	copy((*t).addresses[i+1:], (*t).addresses[i:])
+	(*t).addresses[i] = account.Address
+	leaves := append((*t).levels[0], nil)
+	copy(leaves[i+1:], leaves[i:])
+	leaves[i] = leaf
+	(*t).levels[0] = leaves
+	if i < (*t).moved {
+		(*t).moved = i
+	}
+}
+
+func (t *stateTree) remove(address string) {
+	i, ok := t.find(address)
+	if !ok {
+		return
+	}
+	(*t).addresses = append((*t).addresses[:i], (*t).addresses[i+1:]...)
+	(*t).levels[0] = append((*t).levels[0][:i], (*t).levels[0][i+1:]...)
+	if i < (*t).moved {
+		(*t).moved = i
+	}
+}
+
+// The node at index j of the level above below. As in merkleLevel, a node
+// without a sibling is promoted unchanged.
+func merkleParent(below [][]byte, j int) []byte {
+	if 2*j+1 < len(below) {
+		return merkleNode(below[2*j], below[2*j+1])
+	}
+	return below[2*j]
+}
+
+func (t *stateTree) root() []byte {
+	if len((*t).addresses) == 0 {
+		(*t).levels = (*t).levels[:1]
+		(*t).moved = 0
+		(*t).changed = make(map[int]bool)
+		return make([]byte, sha256.Size)
+	}
+	moved := (*t).moved
+	changed := (*t).changed
+	level := 0
+	for len((*t).levels[level]) > 1 {
+		below := (*t).levels[level]
+		size := (len(below) + 1) / 2
+		if level+1 == len((*t).levels) {
+			(*t).levels = append((*t).levels, nil)
+		}
+		// Nodes whose children all sit before moved are still valid.
+		keep := moved / 2
+		if keep > len((*t).levels[level+1]) {
+			keep = len((*t).levels[level+1])
+		}
+		if keep > size {
+			keep = size
+		}
+		above := (*t).levels[level+1][:keep]
+		for j := keep; j < size; j++ {
+			above = append(above, merkleParent(below, j))
+		}
+		next := make(map[int]bool)
+		for i := range changed {
+			if j := i / 2; j < keep {
+				above[j] = merkleParent(below, j)
+				next[j] = true
+			}
+		}
+		(*t).levels[level+1] = above
+		moved = keep
+		changed = next
+		level++
+	}
+	(*t).levels = (*t).levels[:level+1]
+	(*t).moved = len((*t).addresses)
+	(*t).changed = make(map[int]bool)
+	return (*t).levels[level][0]
+}
+
+// The root the tree would have with accounts set on top of it, leaving the
+// tree itself as it is. When every account already exists, only their
+// paths are rehashed.
+func (t *stateTree) rootWith(accounts map[string]AccountState) []byte {
+	root := t.root()
+	if len(accounts) == 0 {
+		return root
+	}
+	nodes := make(map[int][]byte, len(accounts))
+	for address, account := range accounts {
+		i, ok := t.find(address)
+		if !ok {
+			return t.clone().rootAfter(accounts)
+		}
+		nodes[i] = merkleLeaf(account.leafData())
+	}
+	for level := 0; level+1 < len((*t).levels); level++ {
+		below := (*t).levels[level]
+		node := func(i int) []byte {
+			if hash, ok := nodes[i]; ok {
+				return hash
+			}
+			return below[i]
+		}
+		above := make(map[int][]byte, len(nodes))
+		for i := range nodes {
+			j := i / 2
+			if _, done := above[j]; done {
+				continue
+			}
+			if 2*j+1 < len(below) {
+				above[j] = merkleNode(node(2*j), node(2*j+1))
+			} else {
+				above[j] = node(2 * j)
+			}
+		}
+		nodes = above
+	}
+	return nodes[0]
+}
+
+func (t *stateTree) rootAfter(accounts map[string]AccountState) []byte {
+	for _, account := range accounts {
+		t.set(account)
+	}
+	return t.root()
+}
+
+// Copies a tree with no pending changes.
+func (t *stateTree) clone() *stateTree {
+	var c stateTree
+	c.addresses = append([]string{}, (*t).addresses...)
+	c.levels = make([][][]byte, len((*t).levels))
+	for i, level := range (*t).levels {
+		c.levels[i] = append([][]byte{}, level...)
+	}
+	c.moved = (*t).moved
+	c.changed = make(map[int]bool)
+	return &c
+}
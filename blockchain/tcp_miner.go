@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -23,41 +24,76 @@ type TcpMiner struct {
 	Blocks                      map[string]*Block
 	PendingOutgoingTransactions map[string]*Transaction
 	PendingReceivedTransactions map[string]*Transaction
-	PendingBlocks               map[string]*Set[*Block]
+	Orphans                     *OrphanPool
 	LastBlock                   *Block
 	LastConfirmedBlock          *Block
+	State                       *StateStore
 	ReceivedBlock               *Block
 	Config                      BlockchainConfig
 	Nonce                       uint32
 	//Net                         *FakeNet
 	Emitter *emission.Emitter
+	reorgs  *reorgQueue
 	mu      sync.Mutex
 
 	// Miner's specific variables
 	CurrentBlock *Block
 	MiningRounds uint32
-	Transactions *Set[*Transaction]
+	Mempool      *Mempool
+	Mining       MiningOptions
+	searchCancel chan struct{}
+	hashrate     float64
+	// The cancel channel the running search watches, or nil while no
+	// search is running.
+	searching chan struct{}
+
+	// Snapshots handed out to external miners, and the extra nonce of the
+	// last one.
+	templates          map[string]*Block
+	externalExtraNonce uint64
 
 	//Tcp
 	Net                 *RealNet
 	Connection          string
 	KnownTcpConnections []TcpConnectionInfo
+
+	// Port for the local mining RPC, or empty if external miners are not
+	// served.
+	RpcConnection string
+
+	// Where the mining pool listens for workers, or empty if this node does
+	// not run a pool. A bare port is bound on localhost, like the mining RPC;
+	// a host:port, such as 0.0.0.0:8000, opens the pool to other machines.
+	PoolConnection string
+
+	// Where accepted blocks are saved, or nil to keep them only in memory.
+	Store *BlockStore
 }
 
 type TcpConnectionInfo struct {
 	Name       string
 	Address    string
 	Connection string
+	// The host the peer registered from, as seen by this node rather than
+	// as the peer claims. Empty for peers from the config, which are
+	// reached on localhost.
+	Host string
 }
 
 type TcpData struct {
 	Msg  string
 	Data []byte
+	// The sender's listening port, see RealNet.From. The sender chooses
+	// it, so it only counts along with the host the message came from.
+	From string
 }
 
 type SaveJsonType struct {
 	Name                string
 	Connection          string
+	RpcConnection       string
+	PoolConnection      string
+	DataDir             string
 	KeyPair             rsa.PrivateKey
 	KnownTcpConnections []TcpConnectionInfo
 }
@@ -65,6 +101,7 @@ type SaveJsonType struct {
 func NewTcpMiner(name string, net *RealNet, miningRounds uint32, startingBlock *Block, keyPair *rsa.PrivateKey, connection string, config BlockchainConfig) *TcpMiner {
 	var m TcpMiner
 	m.Net = net
+	m.Net.From = connection
 	m.Name = name
 
 	if keyPair == nil {
@@ -80,19 +117,23 @@ func NewTcpMiner(name string, net *RealNet, miningRounds uint32, startingBlock *
 	m.PendingOutgoingTransactions = make(map[string]*Transaction)
 	m.PendingReceivedTransactions = make(map[string]*Transaction)
 	m.Blocks = make(map[string]*Block)
-	m.PendingBlocks = make(map[string]*Set[*Block])
+	m.Orphans = NewOrphanPool(ORPHAN_MAX_COUNT, ORPHAN_MAX_BYTES, ORPHAN_MAX_PER_PEER, ORPHAN_EXPIRY)
 
 	if startingBlock != nil {
 		m.SetGenesisBlock(startingBlock)
 	}
 
 	m.Emitter = emission.NewEmitter()
+	m.reorgs = newReorgQueue(m.Emitter)
 	m.Emitter.On(PROOF_FOUND, m.ReceiveBlockBytes)
 	m.Emitter.On(MISSING_BLOCK, m.ProvideMissingBlock)
 
 	m.MiningRounds = miningRounds
+	m.Mining = DefaultMiningOptions()
+	m.templates = make(map[string]*Block)
+	m.externalExtraNonce = EXTERNAL_EXTRA_NONCE_START
 
-	m.Transactions = NewSet[*Transaction]()
+	m.Mempool = NewMempool(MEMPOOL_MAX_COUNT, MEMPOOL_MAX_BYTES)
 
 	m.Connection = connection
 
@@ -103,8 +144,12 @@ func (m *TcpMiner) SetGenesisBlock(startingBlock *Block) {
 	if (*m).LastBlock != nil {
 		panic("Cannot set starting block for existing blockchain")
 	}
+	if err := startingBlock.ValidateGenesis((*m).Config); err != nil {
+		panic(err)
+	}
 	(*m).LastConfirmedBlock = startingBlock
 	(*m).LastBlock = startingBlock
+	(*m).State = NewStateStore(startingBlock)
 	blockId, _ := startingBlock.GetHash()
 	(*m).Blocks[blockId] = startingBlock
 }
@@ -123,18 +168,57 @@ func (m *TcpMiner) Initialize(knownTcpConnections []TcpConnectionInfo) {
 
 	go (*m).Emitter.Emit(START_MINING, false)
 	go m.StartListening((*m).Connection)
+	if (*m).RpcConnection != "" {
+		if _, err := ServeMiningRPC(m, "localhost:"+(*m).RpcConnection); err != nil {
+			fmt.Println("Failed to start the mining RPC:", err)
+		}
+	}
+	if (*m).PoolConnection != "" {
+		pool := NewPool(m, POOL_SHARE_SHIFT, POOL_PPLNS_WINDOW)
+		if _, err := pool.Serve(poolBindAddress((*m).PoolConnection)); err != nil {
+			fmt.Println("Failed to start the mining pool:", err)
+		}
+	}
 	for _, conn := range (*m).KnownTcpConnections {
 		(*m).Net.Register(conn)
 	}
 }
 
-func (m *TcpMiner) StartNewSearch(txSet *Set[*Transaction]) {
+// Replays the chain saved in store, which restores the head and the last
+// confirmed block, and then saves every block accepted to it. Call it before
+// Initialize.
+func (m *TcpMiner) LoadBlockStore(store *BlockStore) error {
+	loaded := 0
+	err := store.ForEach(func(block *Block) error {
+		if m.ReceiveBlock(*block) != nil {
+			loaded++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	(*m).Store = store
+	// Our own transactions may already be in the chain.
+	if nonce := (*m).LastBlock.NonceOf((*m).Address); nonce > (*m).Nonce {
+		(*m).Nonce = nonce
+	}
+	fmt.Printf("Loaded %d blocks, head at height %d\n", loaded, (*m).LastBlock.ChainLength)
+	return nil
+}
 
-	//TODO assign currentBlock
-	//target := CalculateTarget(POW_LEADING_ZEROES)
-	target := (*(*m).LastBlock).Target
-	(*m).CurrentBlock = NewBlock((*m).Address, (*m).LastBlock, &target, (*m).Config.coinbaseAmount)
-	//Blockchain.makeBlock(m.address, m.lastBlock)
+// Stops the workers still searching the template that is being replaced.
+func (m *TcpMiner) cancelSearch() {
+	if (*m).searchCancel != nil {
+		close((*m).searchCancel)
+	}
+	(*m).searchCancel = make(chan struct{})
+}
+
+func (m *TcpMiner) StartNewSearch(txSet *Set[*Transaction]) {
 
 	if txSet == nil {
 		txSet = NewSet[*Transaction]()
@@ -143,35 +227,75 @@ func (m *TcpMiner) StartNewSearch(txSet *Set[*Transaction]) {
 	txList := txSet.ToArray()
 
 	for _, transaction := range txList {
-		(*m).Transactions.Add(transaction)
+		(*m).Mempool.Add(transaction)
+	}
+
+	target := (*m).Config.NextTarget((*m).LastBlock)
+	reward := (*m).Config.SubsidyAt((*m).LastBlock.ChainLength + 1)
+	block := NewBlock((*m).Address, (*m).LastBlock, target, reward)
+	// The old template builds on a block that is no longer the head, so it
+	// is dropped even if no new one can be built. FindProof then idles
+	// until the next head.
+	m.cancelSearch()
+	if block == nil {
+		fmt.Println("StartNewSearch() failed to build a block on", (*m).LastBlock.GetHashStr())
+		(*m).CurrentBlock = nil
+		return
 	}
 
-	transactionsArr := (*m).Transactions.ToArray()
-	for _, transaction := range transactionsArr {
-		(*m).CurrentBlock.AddTransaction(transaction)
-	}
-	(*m).Transactions.Clear()
+	(*m).CurrentBlock = block
+	(*m).Config.SetWindowStart((*m).CurrentBlock, (*m).LastBlock)
+
+	(*m).Mempool.FillBlock((*m).CurrentBlock, BLOCK_MAX_TRANSACTIONS, BLOCK_MAX_BYTES)
 
 	(*m).CurrentBlock.Proof = 0
 
 }
 
-// Looks for a "proof".
+// Looks for a "proof". The search runs on the worker goroutines without
+// holding the lock, so that a new head can cancel it.
 func (m *TcpMiner) FindProof(oneAndDone bool) {
 
 	(*m).mu.Lock()
-	defer (*m).mu.Unlock()
+	template := (*m).CurrentBlock
+	if template == nil {
+		(*m).mu.Unlock()
+		return
+	}
+	start := template.Proof
+	rounds := (*m).MiningRounds
+	options := (*m).Mining
+	cancel := (*m).searchCancel
+	// Only the proof changes between attempts, so serialize the header once.
+	search, err := template.NewProofSearch()
+	if err == nil {
+		(*m).searching = cancel
+	}
+	(*m).mu.Unlock()
+	if err != nil {
+		fmt.Println("FindProof() failed to build the block header:", err)
+		return
+	}
 
-	pausePoint := (*m).CurrentBlock.Proof + (*m).MiningRounds
+	result := search.Run(start, rounds, options, cancel)
 
-	for (*m).CurrentBlock.Proof < pausePoint {
-		if (*m).CurrentBlock.hasValidProof() {
-			//m.Log(fmt.Sprintf("found proof for block %d: %d", (*m).CurrentBlock.ChainLength, (*m).CurrentBlock.Proof))
-			m.AnnounceProof()
-			go m.ReceiveBlock(*(*m).CurrentBlock)
-			break
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	(*m).hashrate = result.Hashrate()
+	if (*m).searching == cancel {
+		(*m).searching = nil
+	}
+
+	// The template may have been replaced while we were searching.
+	if (*m).CurrentBlock == template {
+		if result.Found {
+			template.Proof = result.Proof
+			//m.Log(fmt.Sprintf("found proof for block %d: %d", template.ChainLength, template.Proof))
+			m.AnnounceProof(template)
+			go m.ReceiveBlock(*template)
+		} else {
+			template.AdvanceProof(result.Next)
 		}
-		(*m).CurrentBlock.Proof++
 	}
 
 	// If we are testing, don't continue the search
@@ -181,10 +305,58 @@ func (m *TcpMiner) FindProof(oneAndDone bool) {
 	}
 }
 
+// Sets how many workers search for proofs and how much CPU they may use.
+func (m *TcpMiner) SetMiningOptions(workers int, cpuLimit int) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	(*m).Mining = NewMiningOptions(workers, cpuLimit)
+}
+
+// The hashes per second reached by the last batch of the search.
+func (m *TcpMiner) Hashrate() float64 {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	return (*m).hashrate
+}
+
+// Hands out the block being mined to an external miner, with an extra nonce
+// of its own.
+func (m *TcpMiner) GetBlockTemplate() (*BlockTemplate, error) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	if (*m).CurrentBlock == nil {
+		return nil, ErrNoTemplate
+	}
+	pruneTemplates((*m).templates, (*m).CurrentBlock.PrevBlockHash)
+	(*m).externalExtraNonce++
+	return issueTemplate((*m).templates, (*m).CurrentBlock, (*m).externalExtraNonce)
+}
+
+// Accepts a proof found by an external miner for one of our templates. The
+// block is validated against its parent before it is announced.
+func (m *TcpMiner) SubmitBlock(header []byte, proof uint32) error {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	block, err := findSubmission((*m).templates, header, proof)
+	if err != nil {
+		return err
+	}
+	prevBlock, ok := (*m).Blocks[(*block).PrevBlockHash]
+	if !ok {
+		return fmt.Errorf("%w: parent %s is unknown", ErrBadPrevHash, (*block).PrevBlockHash)
+	}
+	if err := block.Clone().ValidateBlock(prevBlock, (*m).Config); err != nil {
+		return err
+	}
+	m.AnnounceProof(block)
+	go m.ReceiveBlock(*block)
+	return nil
+}
+
 // Broadcast the block, with a valid proof included
-func (m *TcpMiner) AnnounceProof() {
+func (m *TcpMiner) AnnounceProof(block *Block) {
 
-	data, err := BlockToBytes((*m).CurrentBlock)
+	data, err := BlockToBytes(block)
 	if err != nil {
 		fmt.Println("AnnounceProof() Marshal Panic:")
 		panic(err)
@@ -195,6 +367,12 @@ func (m *TcpMiner) AnnounceProof() {
 // Validates and adds a block to the list of blocks, possibly
 // updating the head of the blockchain.
 func (m *TcpMiner) ReceiveBlock(b Block) *Block {
+	return m.receiveBlock(b, "")
+}
+
+// Like ReceiveBlock, for a block sent by peer, which is charged for it if
+// the block has to wait for its parent.
+func (m *TcpMiner) receiveBlock(b Block, peer string) *Block {
 	(*m).mu.Lock()
 	defer (*m).mu.Unlock()
 
@@ -205,6 +383,13 @@ func (m *TcpMiner) ReceiveBlock(b Block) *Block {
 		return nil
 	}
 
+	if block.IsGenesisBlock() {
+		if err := block.ValidateGenesis((*m).Config); err != nil {
+			//m.Log(fmt.Sprintf("Rejected block %v: %v\n", blockId, err))
+			return nil
+		}
+	}
+
 	if !block.hasValidProof() && !block.IsGenesisBlock() {
 		//m.Log(fmt.Sprintf("Block %v does not have a valid proof\n", blockId))
 		return nil
@@ -214,163 +399,244 @@ func (m *TcpMiner) ReceiveBlock(b Block) *Block {
 	prevBlock, received := (*m).Blocks[(*block).PrevBlockHash]
 	if !received && !block.IsGenesisBlock() {
 
-		stuckBlocks, received := (*m).PendingBlocks[(*block).PrevBlockHash]
-		if !received {
+		newParent, err := (*m).Orphans.Add(block, peer, (*m).LastBlock)
+		if err != nil {
+			//m.Log(fmt.Sprintf("Rejected orphan block %v: %v\n", blockId, err))
+			return nil
+		}
+		if newParent {
 			m.RequestMissingBlock(block)
-			// TODO: Define a set
-			stuckBlocks = NewSet[*Block]()
 		}
-		stuckBlocks.Add(block)
-		(*m).PendingBlocks[block.PrevBlockHash] = stuckBlocks
 		return nil
 
 	}
 
 	if !block.IsGenesisBlock() {
-		if !block.Rerun(prevBlock) {
+		if err := block.ValidateBlock(prevBlock, (*m).Config); err != nil {
+			//m.Log(fmt.Sprintf("Rejected block %v: %v\n", blockId, err))
 			return nil
 		}
 	}
 
 	blockId, _ = block.GetHash()
 	(*m).Blocks[blockId] = block
-
-	if (*(*m).LastBlock).ChainLength < (*block).ChainLength {
-		(*m).LastBlock = block
-		m.SetLastConfirmed()
+	if (*m).Store != nil {
+		if err := (*m).Store.Append(block); err != nil {
+			fmt.Println("ReceiveBlock() failed to store the block:", err)
+		}
 	}
 
-	unstuckBlocks, received := (*m).PendingBlocks[blockId]
-	var unstuckBlocksArr []*Block
-	if received {
-		unstuckBlocksArr = unstuckBlocks.ToArray()
+	var reorg *Reorg
+	if block.HasMoreWorkThan((*m).LastBlock) {
+		var err error
+		if reorg, err = reorganize((*m).State, block); err != nil {
+			fmt.Println("ReceiveBlock() failed to switch to the new head:", err)
+		} else {
+			(*m).LastBlock = block
+			m.SetLastConfirmed()
+			(*m).reorgs.push(reorg)
+		}
 	}
 
-	delete((*m).PendingBlocks, blockId)
-
-	for _, uBlock := range unstuckBlocksArr {
+	for _, uBlock := range (*m).Orphans.TakeChildren(blockId) {
 		//m.Log(fmt.Sprintf("processing unstuck block %v", uBlock.GetHashStr()))
 		// Need to change the "" into empty []byte
 		go m.ReceiveBlock(*uBlock)
 	}
 	//m.Log(fmt.Sprintf("block %s received", block.GetHashStr()))
 
-	if (*m).CurrentBlock != nil && (*block).ChainLength >= (*m).CurrentBlock.ChainLength {
-		//m.Log("Cutting over to new chain")
-		txSet := m.SyncTransaction(block)
-		m.StartNewSearch(txSet)
+	if reorg != nil {
+		(*m).Mempool.ApplyReorg(reorg, (*m).CurrentBlock)
+		// Only nodes that have started mining have a search to move over,
+		// even if building their last template failed.
+		if (*m).searchCancel != nil {
+			//m.Log("Cutting over to new chain")
+			m.StartNewSearch(nil)
+		}
 	}
 
 	return block
 }
 
 func (m *TcpMiner) ReceiveBlockBytes(bs []byte) *Block {
+	return m.receiveBlockBytes(bs, "")
+}
+
+func (m *TcpMiner) receiveBlockBytes(bs []byte, peer string) *Block {
 
 	block, err := BytesToBlock(bs)
 	if err != nil {
 		panic("Failed to deseralize block")
 	}
 
-	return m.ReceiveBlock(*block)
+	return m.receiveBlock(*block, peer)
 }
 
-// This function should determine what transactions need to be added or deleted.
-func (m *TcpMiner) SyncTransaction(newBlock *Block) *Set[*Transaction] {
-
-	cb := (*m).CurrentBlock
-	cbTxs := NewSet[*Transaction]()
-	nbTxs := NewSet[*Transaction]()
-
-	for newBlock.ChainLength > cb.ChainLength {
-		for _, transaction := range newBlock.Transactions {
-			nbTxs.Add(&transaction.Tx)
-		}
-		newBlock = (*m).Blocks[newBlock.PrevBlockHash]
+// Checks a transaction against the current head and adds it to the
+// mempool. Rejections are logged and returned.
+func (m *TcpMiner) AddTransaction(tx *Transaction) error {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	err := m.addTransaction(tx)
+	if err != nil && !errors.Is(err, ErrKnownTransaction) {
+		m.Log(fmt.Sprintf("Rejected transaction %s: %v", tx.Id(), err))
 	}
+	return err
+}
 
-	currentBlockId, _ := cb.GetHash()
-	newBlockId, _ := newBlock.GetHash()
-	for currentBlockId != newBlockId {
-		for _, transaction := range cb.Transactions {
-			cbTxs.Add(&transaction.Tx)
-		}
-		for _, transaction := range newBlock.Transactions {
-			nbTxs.Add(&transaction.Tx)
-		}
-		newBlock = (*m).Blocks[newBlock.PrevBlockHash]
-		cb = (*m).Blocks[cb.PrevBlockHash]
-
-		if cb != nil {
-			currentBlockId, _ = cb.GetHash()
-			newBlockId, _ = newBlock.GetHash()
-		} else {
-			break
-		}
+// Same as AddTransaction, for callers holding the lock.
+func (m *TcpMiner) addTransaction(tx *Transaction) error {
+	replaced, err := (*m).Mempool.Admit(tx, (*m).LastBlock, (*m).CurrentBlock)
+	if err != nil {
+		return err
 	}
-
-	nbTxsArr := nbTxs.ToArray()
-	for _, transaction := range nbTxsArr {
-		cbTxs.Remove(transaction)
+	if replaced != nil && (*m).CurrentBlock != nil && (*m).CurrentBlock.Contains(replaced) {
+		m.rebuildTemplate(replaced)
+		return nil
+	}
+	if (*m).CurrentBlock != nil && (*tx).Info.Fee >= (*m).Mining.PreemptFee {
+		m.preemptSearch(tx)
 	}
+	return nil
+}
 
-	return cbTxs
+// Starts a new template without a transaction that has been replaced. The
+// rest of the template's transactions go back to the mempool first.
+func (m *TcpMiner) rebuildTemplate(replaced *Transaction) {
+	txSet := NewSet[*Transaction]()
+	for i := range (*m).CurrentBlock.Transactions {
+		tx := &(*m).CurrentBlock.Transactions[i].Tx
+		if tx.Id() != replaced.Id() {
+			txSet.Add(tx)
+		}
+	}
+	m.StartNewSearch(txSet)
 }
 
-// Returns false if transaction is not accepted.Otherwise add the
-// transaction to the current block.
-func (m *TcpMiner) AddTransaction(tx *Transaction) {
-	(*m).mu.Lock()
-	defer (*m).mu.Unlock()
-	(*m).Transactions.Add(tx)
+// Restarts the search on a copy of the template that also includes tx. The
+// workers keep hashing the old header until they see the cancellation, and
+// whatever they find for it is discarded.
+func (m *TcpMiner) preemptSearch(tx *Transaction) {
+	if len((*m).CurrentBlock.Transactions) >= BLOCK_MAX_TRANSACTIONS {
+		return
+	}
+	// A transaction waiting on a nonce gap cannot go in yet.
+	if (*tx).Info.Nonce != (*m).CurrentBlock.NonceOf((*tx).Info.From) {
+		return
+	}
+	template := (*m).CurrentBlock.Clone()
+	if !template.AddTransaction(tx) {
+		return
+	}
+	template.Proof = 0
+	(*m).Mempool.Remove(tx)
+	m.cancelSearch()
+	(*m).CurrentBlock = template
 }
 
 func (m *TcpMiner) AddTransactionBytes(data []byte) {
 
 	tx, err := BytesToTransaction(data)
 	if err != nil {
-		panic("Failed to deserialize data")
+		m.Log(fmt.Sprintf("Rejected transaction that does not decode: %v", err))
+		return
 	}
 	m.AddTransaction(tx)
 }
 
 // The amount of gold available to the client looking at the last confirmed block
-func (m *TcpMiner) ConfirmedBalance() uint32 {
+func (m *TcpMiner) ConfirmedBalance() Amount {
 	return (*m).LastConfirmedBlock.BalanceOf((*m).Address)
 }
 
-// Any gold received in the last confirmed block or before
-func (m *TcpMiner) AvailableGold() uint32 {
+// Any gold received in the last confirmed block or before, less what the
+// pending outgoing transactions will spend. Fails rather than wrapping
+// around if those transactions spend more than the confirmed balance.
+func (m *TcpMiner) AvailableGold() (Amount, error) {
 	(*m).mu.Lock()
 	defer (*m).mu.Unlock()
-	var pendingSpent uint32 = 0
-	for _, tx := range (*m).PendingOutgoingTransactions {
-		pendingSpent += tx.TotalOutput()
+	return m.availableGold()
+}
+
+// Same as AvailableGold, for callers holding the lock.
+func (m *TcpMiner) availableGold() (Amount, error) {
+	pendingSpent, err := TotalSpent((*m).PendingOutgoingTransactions)
+	if err != nil {
+		return 0, err
 	}
-	return m.ConfirmedBalance() - pendingSpent
+	return m.ConfirmedBalance().CheckedSub(pendingSpent)
 }
 
-func (m *TcpMiner) PostTransaction(outputs []Output, fee uint32) {
+// Signs and broadcasts a transaction paying outputs. It is only broadcast
+// if our own mempool accepts it; otherwise the rejection is returned.
+func (m *TcpMiner) PostTransaction(outputs []Output, fee Amount) (*Transaction, error) {
 
-	total := fee
-	for _, output := range outputs {
-		total += output.Amount
+	total, err := OutputsTotal(outputs, fee)
+	if err != nil {
+		return nil, err
 	}
-	if total > m.AvailableGold() {
-		// modify here
-		panic(`Account doesn't have enough balance for transaction`)
+	available, err := m.AvailableGold()
+	if err != nil {
+		return nil, err
 	}
+	if total > available {
+		return nil, fmt.Errorf("%w: spends %d of %d available", ErrInsufficientFunds, total, available)
+	}
+
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
 	// add data to the constructor
-	tx, _ := NewTransaction((*m).Address, (*m).Nonce, (*m).PubKey, nil, fee, outputs, nil)
+	tx, err := NewTransaction((*m).Address, (*m).Nonce, (*m).PubKey, nil, fee, outputs, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	tx.Sign((*m).PrivKey)
-	(*m).mu.Lock()
+	if err := m.addTransaction(tx); err != nil {
+		return nil, err
+	}
 	(*m).PendingOutgoingTransactions[tx.Id()] = tx
 	(*m).Nonce++
 	data, _ := TransactionToBytes(tx)
 	(*m).Net.Broadcast(POST_TRANSACTION, data)
-	(*m).mu.Unlock()
+	return tx, nil
+}
 
-	m.AddTransaction(tx)
+// Replaces a pending transaction with one paying newFee, keeping its nonce
+// and outputs, so that a transaction stuck behind higher fees gets mined.
+// The superseded transaction is dropped from the pending list.
+func (m *TcpMiner) BumpFee(txId string, newFee Amount) (*Transaction, error) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+
+	old, ok := (*m).PendingOutgoingTransactions[txId]
+	if !ok {
+		return nil, ErrNotPending
+	}
+	if minFee, err := (*old).Info.Fee.CheckedAdd(MIN_FEE_BUMP); err != nil || newFee < minFee {
+		return nil, fmt.Errorf("%w: fee %d, replacing fee %d", ErrReplacementUnderpriced, newFee, (*old).Info.Fee)
+	}
+	available, err := m.availableGold()
+	if err != nil {
+		return nil, err
+	}
+	if extra := newFee - (*old).Info.Fee; extra > available {
+		return nil, fmt.Errorf("%w: raising the fee by %d with %d available", ErrInsufficientFunds, extra, available)
+	}
+	tx, err := NewTransaction((*m).Address, (*old).Info.Nonce, (*m).PubKey, nil, newFee, (*old).Info.Outputs, (*old).Info.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.Sign((*m).PrivKey)
+	if err := m.addTransaction(tx); err != nil {
+		return nil, err
+	}
+	delete((*m).PendingOutgoingTransactions, txId)
+	(*m).PendingOutgoingTransactions[tx.Id()] = tx
+	data, _ := TransactionToBytes(tx)
+	(*m).Net.Broadcast(POST_TRANSACTION, data)
+	return tx, nil
 }
 
 // Request the previous block from the network.
@@ -435,19 +701,36 @@ func (m *TcpMiner) SetLastConfirmed() {
 	}
 	(*m).LastConfirmedBlock = block
 	for id, tx := range (*m).PendingOutgoingTransactions {
-		if (*m).LastConfirmedBlock.Contains(tx) {
+		// A transaction whose nonce is used up was either confirmed or
+		// superseded by a replacement that was.
+		if (*m).LastConfirmedBlock.Contains(tx) || (*tx).Info.Nonce < (*m).LastConfirmedBlock.NonceOf((*m).Address) {
 			delete((*m).PendingOutgoingTransactions, id)
 		}
 	}
 }
 
+// Returns the confirmed block at the given height, or nil if the chain is not
+// confirmed that far yet.
+func (m *TcpMiner) ConfirmedBlockAt(height uint32) *Block {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	block := (*m).LastConfirmedBlock
+	if (*block).ChainLength < height {
+		return nil
+	}
+	for block != nil && (*block).ChainLength > height {
+		block = (*m).Blocks[(*block).PrevBlockHash]
+	}
+	return block
+}
+
 // Utility method that displays all confirmed balances for all clients
 func (m *TcpMiner) ShowAllBalances() {
 
 	fmt.Printf("Showing balances:")
-	for id, balance := range (*m).LastConfirmedBlock.Balances {
-		fmt.Printf("	%v", id)
-		fmt.Printf("	%v", balance)
+	for _, account := range (*m).LastConfirmedBlock.Accounts() {
+		fmt.Printf("	%v", account.Address)
+		fmt.Printf("	%v", account.Balance)
 		fmt.Println("")
 	}
 }
@@ -489,6 +772,7 @@ func (m *TcpMiner) RegisterWith(minerConnection string) {
 
 	var conn TcpData
 	conn.Msg = REGISTER
+	conn.From = (*m).Connection
 	conn.Data = make([]byte, len(tcpInfoBytes))
 	copy(conn.Data, tcpInfoBytes)
 
@@ -509,7 +793,20 @@ func (m *TcpMiner) RegisterWith(minerConnection string) {
 	c.Close()
 }
 
-func (m *TcpMiner) HandleConnection(connBytes []byte) {
+// Identifies the sender of a message for the orphan quotas. A registered
+// peer is known by the host it registered from and its listening port, so
+// that nodes sharing a host get a quota each. Anyone else, including a
+// sender claiming the port of a peer on another host, is known by their
+// host alone.
+func (m *TcpMiner) peerKey(host string, from string) string {
+	if from != "" && (*m).Net.RecognizesPeer(host, from) {
+		return net.JoinHostPort(host, from)
+	}
+	return host
+}
+
+// Handles a message from host, the address it came from.
+func (m *TcpMiner) HandleConnection(connBytes []byte, host string) {
 	var receivedData TcpData
 	err := json.Unmarshal(connBytes, &receivedData)
 	if err != nil {
@@ -525,6 +822,8 @@ func (m *TcpMiner) HandleConnection(connBytes []byte) {
 			return
 		}
 
+		tcpInfo.Host = host
+
 		if !(*m).Net.Recognizes(&tcpInfo) {
 			m.RegisterWith(tcpInfo.Connection)
 		}
@@ -532,6 +831,8 @@ func (m *TcpMiner) HandleConnection(connBytes []byte) {
 		fmt.Printf("Registering %v\n", tcpInfo)
 		(*m).Net.Register(tcpInfo)
 		(*m).KnownTcpConnections = append((*m).KnownTcpConnections, tcpInfo)
+	} else if receivedData.Msg == PROOF_FOUND {
+		m.receiveBlockBytes(receivedData.Data, m.peerKey(host, receivedData.From))
 	} else {
 		(*m).Emitter.Emit(receivedData.Msg, receivedData.Data)
 	}
@@ -567,7 +868,8 @@ func (m *TcpMiner) StartListening(port string) {
 			}
 		}
 
-		go m.HandleConnection(data)
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		go m.HandleConnection(data, host)
 		conn.Close()
 	}
 }
@@ -577,7 +879,8 @@ func (m *TcpMiner) ShowPendingOut() string {
 	defer (*m).mu.Unlock()
 	var s string = ""
 	for _, tx := range (*m).PendingOutgoingTransactions {
-		s += fmt.Sprintf("\n    id: %s nonce: %d totalOutput %d\n", tx.Id(), (*tx).Info.Nonce, tx.TotalOutput())
+		totalOutput, _ := tx.TotalOutput()
+		s += fmt.Sprintf("\n    id: %s nonce: %d totalOutput %d\n", tx.Id(), (*tx).Info.Nonce, totalOutput)
 	}
 	return s
 }
@@ -589,6 +892,11 @@ func (m *TcpMiner) SaveJson(fileName string) {
 	jsonData.Name = (*m).Name
 	jsonData.KeyPair = *(*m).PrivKey
 	jsonData.Connection = (*m).Connection
+	jsonData.RpcConnection = (*m).RpcConnection
+	jsonData.PoolConnection = (*m).PoolConnection
+	if (*m).Store != nil {
+		jsonData.DataDir = (*m).Store.Dir()
+	}
 	jsonData.KnownTcpConnections = append(jsonData.KnownTcpConnections, (*m).KnownTcpConnections...)
 	jsonBytes, err := json.Marshal(jsonData)
 	if err != nil {
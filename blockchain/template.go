@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+)
+
+// Extra nonces handed to external miners start here, well above any extra
+// nonce the node's own workers will reach, so no two miners ever hash the
+// same header.
+const EXTERNAL_EXTRA_NONCE_START uint64 = 1 << 32
+
+// Proofs an external miner tries per template before it asks for a new one.
+const EXTERNAL_MINING_ROUNDS uint32 = 1 << 22
+
+var ErrNoTemplate = errors.New("node is not mining")
+var ErrUnknownTemplate = errors.New("unknown block template")
+
+// Work for a miner outside the node. Header is the serialized BlockHeader
+// with the proof set to zero and an extra nonce reserved for this template,
+// so the miner only needs to vary the proof.
+type BlockTemplate struct {
+	Header       []byte
+	Target       string
+	ChainLength  uint32
+	Transactions []string
+}
+
+// Identifies the block a header was built from, whatever proof and extra
+// nonce the miner used.
+func templateId(header BlockHeader) string {
+	header.ExtraNonce = 0
+	header.Proof = 0
+	hash := header.Hash()
+	return hex.EncodeToString(hash[:])
+}
+
+// Records a snapshot of the block being mined, so that a header submitted
+// later can be matched back to its transactions.
+func issueTemplate(templates map[string]*Block, currentBlock *Block, extraNonce uint64) (*BlockTemplate, error) {
+	block := currentBlock.Clone()
+	(*block).ExtraNonce = 0
+	(*block).Proof = 0
+	header, err := block.Header()
+	if err != nil {
+		return nil, err
+	}
+	templates[templateId(*header)] = block
+
+	(*header).ExtraNonce = extraNonce
+	data, _ := header.MarshalBinary()
+	template := BlockTemplate{
+		Header:      data,
+		Target:      hex.EncodeToString((*header).Target[:]),
+		ChainLength: (*block).ChainLength,
+	}
+	for _, v := range (*block).Transactions {
+		template.Transactions = append(template.Transactions, v.Id)
+	}
+	return &template, nil
+}
+
+// Templates built on an older head can no longer extend the chain.
+func pruneTemplates(templates map[string]*Block, headId string) {
+	for id, block := range templates {
+		if (*block).PrevBlockHash != headId {
+			delete(templates, id)
+		}
+	}
+}
+
+// Rebuilds the block a miner found a proof for, checking the proof.
+func findSubmission(templates map[string]*Block, headerData []byte, proof uint32) (*Block, error) {
+	var header BlockHeader
+	if err := header.UnmarshalBinary(headerData); err != nil {
+		return nil, err
+	}
+	template, ok := templates[templateId(header)]
+	if !ok {
+		return nil, ErrUnknownTemplate
+	}
+	block := template.Clone()
+	(*block).ExtraNonce = header.ExtraNonce
+	(*block).Proof = proof
+	if !block.hasValidProof() {
+		return nil, fmt.Errorf("%w: proof %d does not meet the target", ErrBadProof, proof)
+	}
+	return block, nil
+}
+
+// What a node offers to external miners.
+type MiningNode interface {
+	GetBlockTemplate() (*BlockTemplate, error)
+	SubmitBlock(header []byte, proof uint32) error
+}
+
+// Serves a MiningNode over net/rpc as "Mining.GetBlockTemplate" and
+// "Mining.SubmitBlock".
+type MiningService struct {
+	node MiningNode
+}
+
+type TemplateRequest struct{}
+
+type SubmitRequest struct {
+	Header []byte
+	Proof  uint32
+}
+
+type SubmitReply struct{}
+
+func (s *MiningService) GetBlockTemplate(request *TemplateRequest, reply *BlockTemplate) error {
+	template, err := (*s).node.GetBlockTemplate()
+	if err != nil {
+		return err
+	}
+	*reply = *template
+	return nil
+}
+
+func (s *MiningService) SubmitBlock(request *SubmitRequest, reply *SubmitReply) error {
+	return (*s).node.SubmitBlock((*request).Header, (*request).Proof)
+}
+
+// Listens for external miners on the given address, which should be a
+// local one since the API is not authenticated.
+func ServeMiningRPC(node MiningNode, address string) (net.Listener, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Mining", &MiningService{node: node}); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go server.Accept(l)
+	return l, nil
+}
+
+// Mines for a node over RPC. Every batch starts from a fresh template, which
+// keeps the miner on the node's current head and gives it a new extra nonce.
+func RunExternalMiner(address string, rounds uint32, options MiningOptions) error {
+	client, err := rpc.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		var template BlockTemplate
+		if err := client.Call("Mining.GetBlockTemplate", &TemplateRequest{}, &template); err != nil {
+			return err
+		}
+		var header BlockHeader
+		if err := header.UnmarshalBinary(template.Header); err != nil {
+			return err
+		}
+		search := header.NewProofSearch()
+		result := search.Run(0, rounds, options, nil)
+		fmt.Printf("Block %d: %.0f hashes/s\n", template.ChainLength, result.Hashrate())
+		if !result.Found {
+			continue
+		}
+		request := SubmitRequest{Header: template.Header, Proof: result.Proof}
+		if err := client.Call("Mining.SubmitBlock", &request, &SubmitReply{}); err != nil {
+			fmt.Printf("Block %d rejected: %v\n", template.ChainLength, err)
+		} else {
+			fmt.Printf("Block %d accepted with proof %d\n", template.ChainLength, result.Proof)
+		}
+	}
+}
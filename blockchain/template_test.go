@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestSubmitBlock(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	miner := NewMiner("Minnie", NewFakeNet(), NUM_ROUNDS_MINING, genesis, nil, config)
+	miner.StartNewSearch(nil)
+
+	template, err := miner.GetBlockTemplate()
+	if err != nil {
+		t.Fatalf("GetBlockTemplate() Error: %v", err)
+	}
+	other, _ := miner.GetBlockTemplate()
+	var header, otherHeader BlockHeader
+	header.UnmarshalBinary(template.Header)
+	otherHeader.UnmarshalBinary(other.Header)
+	if header.ExtraNonce == otherHeader.ExtraNonce {
+		t.Fatalf("Two templates share extra nonce %d", header.ExtraNonce)
+	}
+
+	proof := mineHeader(t, &header)
+
+	badProof := uint32(0)
+	for header.NewProofSearch().Check(badProof) {
+		badProof++
+	}
+	if err := miner.SubmitBlock(template.Header, badProof); !errors.Is(err, ErrBadProof) {
+		t.Fatalf("SubmitBlock() with a bad proof returned %v, expected ErrBadProof", err)
+	}
+	tampered := append([]byte{}, template.Header...)
+	tampered[40] ^= 1
+	if err := miner.SubmitBlock(tampered, proof); !errors.Is(err, ErrUnknownTemplate) {
+		t.Fatalf("SubmitBlock() with an unknown header returned %v, expected ErrUnknownTemplate", err)
+	}
+	if err := miner.SubmitBlock(template.Header, proof); err != nil {
+		t.Fatalf("SubmitBlock() Error: %v", err)
+	}
+
+	// The accepted block becomes the miner's new head.
+	var head *Block
+	for i := 0; i < 50; i++ {
+		miner.mu.Lock()
+		head = miner.LastBlock
+		miner.mu.Unlock()
+		if head != genesis {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if head.ChainLength != 1 || head.ExtraNonce != header.ExtraNonce {
+		t.Fatalf("Submitted block did not become the head")
+	}
+}
+
+func TestMiningRPC(t *testing.T) {
+	genesis, config, _ := MakeGenesisDefault(map[string]Amount{})
+	miner := NewMiner("Minnie", NewFakeNet(), NUM_ROUNDS_MINING, genesis, nil, config)
+	miner.StartNewSearch(nil)
+
+	l, err := ServeMiningRPC(miner, "localhost:0")
+	if err != nil {
+		t.Fatalf("ServeMiningRPC() Error: %v", err)
+	}
+	defer l.Close()
+	client, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("rpc.Dial() Error: %v", err)
+	}
+	defer client.Close()
+
+	var template BlockTemplate
+	if err := client.Call("Mining.GetBlockTemplate", &TemplateRequest{}, &template); err != nil {
+		t.Fatalf("Mining.GetBlockTemplate Error: %v", err)
+	}
+	var header BlockHeader
+	if err := header.UnmarshalBinary(template.Header); err != nil || template.ChainLength != 1 {
+		t.Fatalf("Received a bad template: %v", err)
+	}
+
+	// Rejections reach the external miner as errors.
+	request := SubmitRequest{Header: template.Header[:10], Proof: 0}
+	if err := client.Call("Mining.SubmitBlock", &request, &SubmitReply{}); err == nil {
+		t.Fatalf("Mining.SubmitBlock accepted a truncated header")
+	}
+	request = SubmitRequest{Header: template.Header, Proof: mineHeader(t, &header)}
+	if err := client.Call("Mining.SubmitBlock", &request, &SubmitReply{}); err != nil {
+		t.Fatalf("Mining.SubmitBlock Error: %v", err)
+	}
+}
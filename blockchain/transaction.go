@@ -14,14 +14,14 @@ import (
 
 type Output struct {
 	Address string
-	Amount  uint32
+	Amount  Amount
 }
 
 type TransactionInfo struct {
 	From    string
 	Nonce   uint32
 	Pubkey  rsa.PublicKey //256 bits, 32 bytes
-	Fee     uint32
+	Fee     Amount
 	Outputs []Output // slice
 	Data    []byte
 }
@@ -31,7 +31,7 @@ type Transaction struct {
 	Sig  []byte
 }
 
-func NewTransaction(from string, nonce uint32, pubkey *rsa.PublicKey, sig []byte, fee uint32, outputs []Output, data []byte) (*Transaction, error) {
+func NewTransaction(from string, nonce uint32, pubkey *rsa.PublicKey, sig []byte, fee Amount, outputs []Output, data []byte) (*Transaction, error) {
 	var tx Transaction
 	tx.Info.From = from
 	tx.Info.Nonce = nonce
@@ -101,8 +101,9 @@ func (tran *Transaction) ToString() string {
 	return info
 }
 
+// The hash that is signed, taken over the binary encoding of the info.
 func (txInfo *TransactionInfo) GetHash() []byte {
-	data, err := TransactionInfoToBytes(txInfo)
+	data, err := txInfo.MarshalBinary()
 	if err != nil {
 		return nil
 	}
@@ -111,7 +112,7 @@ func (txInfo *TransactionInfo) GetHash() []byte {
 }
 
 func (tx *Transaction) GetHashStr() string {
-	data, _ := TransactionToBytes(tx)
+	data, _ := tx.MarshalBinary()
 	hashed := sha256.Sum256(data)
 	return hex.EncodeToString(hashed[:])
 }
@@ -139,11 +140,32 @@ func (tx *Transaction) VerifySignature() bool {
 	return err == nil
 }
 
-func (tx *Transaction) TotalOutput() uint32 {
-	var amount uint32 = 0
-	for _, v := range (*tx).Info.Outputs {
-		amount += v.Amount
+// The total the sender pays: every output plus the fee.
+func (tx *Transaction) TotalOutput() (Amount, error) {
+	return OutputsTotal((*tx).Info.Outputs, (*tx).Info.Fee)
+}
+
+func OutputsTotal(outputs []Output, fee Amount) (Amount, error) {
+	amounts := make([]Amount, 0, len(outputs)+1)
+	for _, v := range outputs {
+		amounts = append(amounts, v.Amount)
+	}
+	amounts = append(amounts, fee)
+	return SumAmounts(amounts...)
+}
+
+// The total that a set of transactions spends, outputs and fees included.
+func TotalSpent(txs map[string]*Transaction) (Amount, error) {
+	var total Amount = 0
+	for _, tx := range txs {
+		spent, err := tx.TotalOutput()
+		if err != nil {
+			return 0, err
+		}
+		total, err = total.CheckedAdd(spent)
+		if err != nil {
+			return 0, err
+		}
 	}
-	amount += (*tx).Info.Fee
-	return amount
+	return total, nil
 }
@@ -122,9 +122,13 @@ func TestTotalOutput(t *testing.T) {
 		t.Fatalf(`NewTransaction(from, nonce, pubkey, outputs) Error: %v`, err1)
 	}
 
-	value := tx.TotalOutput()
-	if value != 300 {
-		t.Fatalf(`TotalOutput() Error: expect to return 300, but actually return %d`, value)
+	// Outputs of 100 and 200 plus a fee of 100
+	value, err := tx.TotalOutput()
+	if err != nil {
+		t.Fatalf(`TotalOutput() Error: %v`, err)
+	}
+	if value != 400 {
+		t.Fatalf(`TotalOutput() Error: expect to return 400, but actually return %d`, value)
 	}
 	fmt.Printf("Total output is %d\n", value)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Blocks whose timestamp is further ahead of our clock than this are rejected.
+const MAX_FUTURE_BLOCK_TIME time.Duration = 2 * time.Minute
+
+// Reasons a block can be rejected. ValidateBlock wraps these with details,
+// so callers should compare them with errors.Is.
+var (
+	ErrBadPrevHash    = errors.New("block does not reference its parent")
+	ErrBadChainLength = errors.New("block has the wrong chain length")
+	ErrBadTarget      = errors.New("block has an unexpected target")
+	ErrBadCoinbase    = errors.New("block claims the wrong coinbase reward")
+	ErrBadTimestamp   = errors.New("block timestamp is out of bounds")
+	ErrBadProof       = errors.New("block does not have a valid proof")
+	ErrBadTransaction = errors.New("block contains an invalid transaction")
+	ErrBadTxRoot      = errors.New("block transaction root does not match its transactions")
+	ErrBadStateRoot   = errors.New("block state root does not match the replayed state")
+	ErrBadGenesis     = errors.New("block is not the pinned genesis block")
+)
+
+// A chain is only valid if it starts at the genesis block pinned in the
+// config. Every other block must extend a block we already accepted, so
+// rejecting any other height-0 block keeps foreign chains out entirely.
+func (block *Block) ValidateGenesis(config BlockchainConfig) error {
+	blockHash, err := block.GetHash()
+	if err != nil {
+		return err
+	}
+	if blockHash != config.genesisHash {
+		return fmt.Errorf("%w: expected %s, got %s", ErrBadGenesis, config.genesisHash, blockHash)
+	}
+	// The starting balances are committed through the state root.
+	if block.ComputeStateRoot() != (*block).StateRoot {
+		return fmt.Errorf("%w: balances do not match the state root", ErrBadGenesis)
+	}
+	return nil
+}
+
+// Checks every consensus rule for a block that extends prevBlock. The cheap
+// header checks run first, then the proof-of-work, and finally all
+// transactions are replayed on top of prevBlock. On success the block's
+// derived state (balances, nonces, chain work and retargeting window) has
+// been recomputed from prevBlock.
+func (block *Block) ValidateBlock(prevBlock *Block, config BlockchainConfig) error {
+	prevBlockHash, err := prevBlock.GetHash()
+	if err != nil {
+		return err
+	}
+	if (*block).PrevBlockHash != prevBlockHash {
+		return fmt.Errorf("%w: expected %s, got %s", ErrBadPrevHash, prevBlockHash, (*block).PrevBlockHash)
+	}
+
+	if (*block).ChainLength != (*prevBlock).ChainLength+1 {
+		return fmt.Errorf("%w: expected %d, got %d", ErrBadChainLength, (*prevBlock).ChainLength+1, (*block).ChainLength)
+	}
+
+	expectedTarget := config.NextTarget(prevBlock)
+	if (*block).Target.Cmp(expectedTarget) != 0 {
+		return fmt.Errorf("%w: expected %x, got %x", ErrBadTarget, expectedTarget, &(*block).Target)
+	}
+
+	expectedReward := config.SubsidyAt((*block).ChainLength)
+	if (*block).CoinbaseReward != expectedReward {
+		return fmt.Errorf("%w: expected %d, got %d", ErrBadCoinbase, expectedReward, (*block).CoinbaseReward)
+	}
+
+	if !(*block).Timestamp.After((*prevBlock).Timestamp) {
+		return fmt.Errorf("%w: %v is not after parent %v", ErrBadTimestamp, (*block).Timestamp, (*prevBlock).Timestamp)
+	}
+	if (*block).Timestamp.After(time.Now().Add(MAX_FUTURE_BLOCK_TIME)) {
+		return fmt.Errorf("%w: %v is too far in the future", ErrBadTimestamp, (*block).Timestamp)
+	}
+
+	if !block.hasValidProof() {
+		return ErrBadProof
+	}
+
+	// Rerun recomputes both roots, so remember what the header claimed.
+	claimedTxRoot := (*block).TxRoot
+	claimedStateRoot := (*block).StateRoot
+	if !block.Rerun(prevBlock) {
+		return ErrBadTransaction
+	}
+	if (*block).TxRoot != claimedTxRoot {
+		return fmt.Errorf("%w: expected %s, got %s", ErrBadTxRoot, (*block).TxRoot, claimedTxRoot)
+	}
+	if (*block).StateRoot != claimedStateRoot {
+		return fmt.Errorf("%w: expected %s, got %s", ErrBadStateRoot, (*block).StateRoot, claimedStateRoot)
+	}
+	config.SetWindowStart(block, prevBlock)
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateBlock(t *testing.T) {
+	privKey1, pubKey1, _ := GenerateKeypair()
+	_, pubKey2, _ := GenerateKeypair()
+	address1 := GenerateAddress(pubKey1)
+	address2 := GenerateAddress(pubKey2)
+	genesis, config, _ := MakeGenesis(4, COINBASE_AMT_ALLOWED, DEFAULT_TX_FEE, CONFIRMED_DEPTH, map[string]Amount{address1: 100})
+
+	// Builds a block on top of genesis, lets the test tamper with it, and
+	// then searches for a proof so that only the tampered rule is broken.
+	makeBlock := func(tamper func(block *Block)) *Block {
+		block := NewBlock(address2, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+		// Settle the roots first, so a tampered root is not recomputed.
+		block.refreshRoots()
+		tamper(block)
+		for !block.hasValidProof() {
+			block.Proof++
+		}
+		return block
+	}
+
+	overspend, _ := NewTransaction(address1, 0, pubKey1, nil, config.defaultTxFee, []Output{{Address: address2, Amount: 500}}, nil)
+	overspend.Sign(privKey1)
+
+	tests := []struct {
+		name     string
+		tamper   func(block *Block)
+		expected error
+	}{
+		{"valid", func(block *Block) {}, nil},
+		{"prev hash", func(block *Block) { block.PrevBlockHash = genesis.StateRoot }, ErrBadPrevHash},
+		{"chain length", func(block *Block) { block.ChainLength = 5 }, ErrBadChainLength},
+		{"target", func(block *Block) { block.Target = *CalculateTarget(2) }, ErrBadTarget},
+		{"coinbase", func(block *Block) { block.CoinbaseReward = 1000 }, ErrBadCoinbase},
+		{"past timestamp", func(block *Block) { block.Timestamp = genesis.Timestamp }, ErrBadTimestamp},
+		{"future timestamp", func(block *Block) { block.Timestamp = time.Now().Add(time.Hour) }, ErrBadTimestamp},
+		{"tx root", func(block *Block) { block.TxRoot = genesis.GetHashStr() }, ErrBadTxRoot},
+		{"state root", func(block *Block) { block.StateRoot = genesis.TxRoot }, ErrBadStateRoot},
+		{"transaction", func(block *Block) {
+			block.Transactions = append(block.Transactions, TransactionType{Id: overspend.Id(), Tx: *overspend})
+		}, ErrBadTransaction},
+	}
+
+	// After a halving the old reward is no longer accepted.
+	halved := config
+	halved.SetEmissionSchedule(config.coinbaseAmount, 1, 0)
+	block := makeBlock(func(block *Block) {})
+	if err := block.ValidateBlock(genesis, halved); err != nil {
+		t.Fatalf("halving: unexpected error %v", err)
+	}
+	second := NewBlock(address2, block, halved.NextTarget(block), config.coinbaseAmount)
+	for !second.hasValidProof() {
+		second.Proof++
+	}
+	if err := second.ValidateBlock(block, halved); !errors.Is(err, ErrBadCoinbase) {
+		t.Fatalf("halving: expected %v, got %v", ErrBadCoinbase, err)
+	}
+
+	for _, test := range tests {
+		block := makeBlock(test.tamper)
+		err := block.ValidateBlock(genesis, config)
+		if test.expected == nil && err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+
+	// A block without a valid proof is rejected even if everything else is fine.
+	block = NewBlock(address2, genesis, config.NextTarget(genesis), config.coinbaseAmount)
+	for block.hasValidProof() {
+		block.Proof++
+	}
+	if err := block.ValidateBlock(genesis, config); !errors.Is(err, ErrBadProof) {
+		t.Fatalf("proof: expected %v, got %v", ErrBadProof, err)
+	}
+}